@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 
 	flags "github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
 	"github.com/wish/targetsync"
@@ -18,6 +20,7 @@ var opts struct {
 	LogLevel   string `long:"log-level" env:"LOG_LEVEL" description:"Log level" default:"info"`
 	BindAddr   string `long:"bind-address" env:"BIND_ADDRESS" description:"address for binding checks to"`
 	LocalAddr  string `long:"local-address" env:"LOCAL_ADDRESS" description:"address of this process"`
+	DryRun     bool   `long:"dry-run" env:"DRY_RUN" description:"only log and record changes to the destination"`
 }
 
 func main() {
@@ -27,6 +30,22 @@ func main() {
 	}()
 
 	parser := flags.NewParser(&opts, flags.Default)
+	// With no command we run as a daemon
+	parser.SubcommandsOptional = true
+	if _, err := parser.AddCommand("diff", "Show the differences between source and destination",
+		"Take one snapshot of the source and destination of each pipeline and print the differences. "+
+			"Exits 0 if in sync, 1 on error and 2 if there are differences.", &diffOpts); err != nil {
+		logrus.Fatalf("Error adding command: %v", err)
+	}
+	if _, err := parser.AddCommand("sync-once", "Sync the source to the destination once and exit",
+		"Take one snapshot of the source and destination of each pipeline and apply the differences (without delay or locking). "+
+			"Exits 0 on success, 1 on error and 3 if removals were blocked by the safety thresholds.", &syncOnceOpts); err != nil {
+		logrus.Fatalf("Error adding command: %v", err)
+	}
+	if _, err := parser.AddCommand("validate", "Validate the config file",
+		"Load and validate the config file, reporting every problem found. Exits 0 if the config is valid and 1 otherwise.", &struct{}{}); err != nil {
+		logrus.Fatalf("Error adding command: %v", err)
+	}
 	if _, err := parser.Parse(); err != nil {
 		// If the error was from the parser, then we can simply return
 		// as Parse() prints the error already
@@ -53,38 +72,33 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if parser.Active != nil && parser.Active.Name == "validate" {
+		os.Exit(runValidate(opts.ConfigFile))
+	}
+
 	// Load config
 	cfg, err := targetsync.ConfigFromFile(opts.ConfigFile)
 	if err != nil {
 		logrus.Fatalf("Unable to load config: %v", err)
 	}
 
-	var src targetsync.TargetSourceLocker
-	// Create syncer
-	if cfg.ConsulConfig.ServiceName != "" {
-		src, err = targetsync.NewConsulSource(&cfg.ConsulConfig)
-		if err != nil {
-			logrus.Fatalf("Error creating consul source: %v", err)
-		}
-	} else {
-		src, err = targetsync.NewK8sEndpointsSource(&cfg.K8sEndpointsConfig)
-		if err != nil {
-			logrus.Fatalf("Error creating k8s endpoints source: %v", err)
+	pipelines := cfg.GetPipelines()
+	if opts.DryRun {
+		for _, p := range pipelines {
+			p.SyncConfig.DryRun = true
 		}
 	}
 
-	dst, err := targetsync.NewAWSTargetGroup(&cfg.AWSConfig)
-	if err != nil {
-		logrus.Fatalf("Error creating aws dest: %v", err)
+	if parser.Active != nil {
+		switch parser.Active.Name {
+		case "diff":
+			os.Exit(runDiff(ctx, pipelines))
+		case "sync-once":
+			os.Exit(runSyncOnce(ctx, pipelines))
+		}
 	}
 
-	syncer := &targetsync.Syncer{
-		Config:    &cfg.SyncConfig,
-		LocalAddr: opts.LocalAddr,
-		Locker:    src,
-		Src:       src,
-		Dst:       dst,
-	}
+	sup := &supervisor{LocalAddr: opts.LocalAddr}
 
 	if opts.BindAddr != "" {
 		l, err := net.Listen("tcp", opts.BindAddr)
@@ -94,17 +108,35 @@ func main() {
 
 		go func() {
 			http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-				logrus.Infof("ready? %v", syncer.Started)
-				if !syncer.Started {
+				started := sup.Started(pipelines)
+				logrus.Infof("ready? %v", started)
+				if !started {
 					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				}
 			})
+			http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(sup.Status()); err != nil {
+					logrus.Errorf("Error encoding status: %v", err)
+				}
+			})
+			http.HandleFunc("/dry-run", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(sup.DryRunChanges()); err != nil {
+					logrus.Errorf("Error encoding dry-run changes: %v", err)
+				}
+			})
+			http.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(sup.TargetHealth(r.Context())); err != nil {
+					logrus.Errorf("Error encoding target health: %v", err)
+				}
+			})
+			http.Handle("/metrics", promhttp.Handler())
 			logrus.Error(http.Serve(l, http.DefaultServeMux))
 		}()
 	}
 
 	// Run
-	if err := syncer.Run(ctx); err != nil {
-		logrus.Errorf("Error running targetSync: %v", err)
-	}
+	sup.Run(ctx, pipelines)
 }
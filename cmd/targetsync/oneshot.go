@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wish/targetsync"
+)
+
+// Exit codes for the one-shot commands
+const (
+	exitOK = 0
+	// exitError means something went wrong talking to the source or destination
+	exitError = 1
+	// exitDiff means the destination is not in sync with the source
+	exitDiff = 2
+	// exitBlocked means removals were refused by the safety thresholds
+	exitBlocked = 3
+)
+
+// oneShotOpts are the options for the commands which run once and exit
+type oneShotOpts struct {
+	Pipeline string        `long:"pipeline" description:"only run the named pipeline (defaults to all)"`
+	JSON     bool          `long:"json" description:"print the output as JSON"`
+	Timeout  time.Duration `long:"timeout" description:"timeout for fetching targets" default:"30s"`
+}
+
+var (
+	diffOpts     oneShotOpts
+	syncOnceOpts oneShotOpts
+)
+
+// oneShotResult is the result of a one-shot command for a single pipeline
+type oneShotResult struct {
+	Pipeline string                   `json:"pipeline"`
+	Diffs    []*targetsync.TargetDiff `json:"diffs,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// selectPipelines returns the pipelines matching `name` (all if empty)
+func selectPipelines(pipelines []*targetsync.PipelineConfig, name string) ([]*targetsync.PipelineConfig, error) {
+	if name == "" {
+		return pipelines, nil
+	}
+	for _, p := range pipelines {
+		if p.Name == name {
+			return []*targetsync.PipelineConfig{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown pipeline %q", name)
+}
+
+// runOneShot runs `f` against the syncer of each selected pipeline, prints the
+// results and returns the exit code
+func runOneShot(ctx context.Context, o *oneShotOpts, pipelines []*targetsync.PipelineConfig, f func(context.Context, *targetsync.Syncer) ([]*targetsync.TargetDiff, error)) int {
+	pipelines, err := selectPipelines(pipelines, o.Pipeline)
+	if err != nil {
+		logrus.Errorf("%v", err)
+		return exitError
+	}
+
+	code := exitOK
+	results := make([]*oneShotResult, 0, len(pipelines))
+	for _, p := range pipelines {
+		result := &oneShotResult{Pipeline: p.Name}
+		results = append(results, result)
+
+		pCtx, cancel := context.WithTimeout(ctx, o.Timeout)
+		syncer, err := newSyncer(pCtx, p, "")
+		if err == nil {
+			result.Diffs, err = f(pCtx, syncer)
+			closeSyncer(syncer)
+		}
+		cancel()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		switch errCode := errorCode(err); {
+		case errCode == exitError:
+			code = exitError
+		case errCode == exitBlocked:
+			if code == exitOK || code == exitDiff {
+				code = exitBlocked
+			}
+		case code == exitOK:
+			for _, diff := range result.Diffs {
+				if !diff.Empty() {
+					code = exitDiff
+				}
+			}
+		}
+	}
+
+	if o.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			logrus.Errorf("Error encoding results: %v", err)
+			return exitError
+		}
+	} else {
+		for _, result := range results {
+			printResult(os.Stdout, result)
+		}
+	}
+	return code
+}
+
+// errorCode returns the exit code for `err`. Removals being blocked only takes
+// precedence when none of the destinations failed otherwise
+func errorCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var dstErrs targetsync.DestinationErrors
+	if errors.As(err, &dstErrs) {
+		for _, dstErr := range dstErrs {
+			if !errors.Is(dstErr, targetsync.ErrRemovalsBlocked) {
+				return exitError
+			}
+		}
+		return exitBlocked
+	}
+	if errors.Is(err, targetsync.ErrRemovalsBlocked) {
+		return exitBlocked
+	}
+	return exitError
+}
+
+// printResult prints a human-readable `result` to `w`
+func printResult(w io.Writer, result *oneShotResult) {
+	fmt.Fprintf(w, "pipeline %s:\n", result.Pipeline)
+	if result.Error != "" {
+		fmt.Fprintf(w, "  error: %s\n", result.Error)
+	}
+	for _, diff := range result.Diffs {
+		indent := "  "
+		if len(result.Diffs) > 1 {
+			fmt.Fprintf(w, "  destination %s:\n", diff.Destination)
+			indent = "    "
+		}
+		if diff.Empty() && len(diff.PortMismatches) == 0 {
+			fmt.Fprintf(w, "%sin sync\n", indent)
+			continue
+		}
+		for _, target := range diff.Add {
+			fmt.Fprintf(w, "%s+ %s\n", indent, target.Key())
+		}
+		for _, target := range diff.Remove {
+			fmt.Fprintf(w, "%s- %s\n", indent, target.Key())
+		}
+		for _, m := range diff.PortMismatches {
+			fmt.Fprintf(w, "%s~ %s ports source=%v destination=%v\n", indent, m.IP, m.SourcePorts, m.DestinationPorts)
+		}
+	}
+}
+
+// runDiff prints the differences between the source and destination
+func runDiff(ctx context.Context, pipelines []*targetsync.PipelineConfig) int {
+	// Nothing is changed, so we only need read access to the destinations
+	for _, p := range pipelines {
+		p.SyncConfig.DryRun = true
+	}
+	return runOneShot(ctx, &diffOpts, pipelines, func(ctx context.Context, s *targetsync.Syncer) ([]*targetsync.TargetDiff, error) {
+		return s.Diff(ctx)
+	})
+}
+
+// runSyncOnce applies the differences between the source and destination once
+func runSyncOnce(ctx context.Context, pipelines []*targetsync.PipelineConfig) int {
+	code := runOneShot(ctx, &syncOnceOpts, pipelines, func(ctx context.Context, s *targetsync.Syncer) ([]*targetsync.TargetDiff, error) {
+		return s.SyncOnce(ctx)
+	})
+	// The changes were applied, so a diff isn't a failure
+	if code == exitDiff {
+		code = exitOK
+	}
+	return code
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wish/targetsync"
+)
+
+// restartDelay is how long to wait before restarting a failed pipeline
+var restartDelay = 30 * time.Second
+
+// newSyncer creates the source, destination and syncer for a single pipeline
+func newSyncer(ctx context.Context, cfg *targetsync.PipelineConfig, localAddr string) (*targetsync.Syncer, error) {
+	var src targetsync.TargetSource
+	var err error
+	if cfg.ConsulConfig.ServiceName != "" {
+		src, err = targetsync.NewConsulSource(&cfg.ConsulConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating consul source: %v", err)
+		}
+	} else if cfg.K8sEndpointSlicesConfig.ServiceName != "" {
+		src, err = targetsync.NewK8sEndpointSliceSource(&cfg.K8sEndpointSlicesConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating k8s endpoint slice source: %v", err)
+		}
+	} else if cfg.EtcdConfig.Prefix != "" {
+		src, err = targetsync.NewEtcdSource(&cfg.EtcdConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating etcd source: %v", err)
+		}
+	} else if cfg.FileConfig.Path != "" {
+		src, err = targetsync.NewFileSource(&cfg.FileConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating file source: %v", err)
+		}
+	} else if cfg.DNSConfig.Name != "" {
+		src, err = targetsync.NewDNSSource(&cfg.DNSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating dns source: %v", err)
+		}
+	} else {
+		src, err = targetsync.NewK8sEndpointsSource(&cfg.K8sEndpointsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating k8s endpoints source: %v", err)
+		}
+	}
+
+	locker, err := newLocker(&cfg.LockConfig, src)
+	if err != nil {
+		closeAll(src)
+		return nil, err
+	}
+
+	dsts, err := targetsync.NewAWSTargetGroups(ctx, &cfg.AWSConfig, cfg.SyncConfig.DryRun)
+	if err != nil {
+		closeAll(src, locker)
+		return nil, fmt.Errorf("Error creating aws dest: %v", err)
+	}
+
+	return &targetsync.Syncer{
+		Name:      cfg.Name,
+		Config:    &cfg.SyncConfig,
+		LocalAddr: localAddr,
+		Locker:    locker,
+		Src:       src,
+		Dsts:      dsts,
+	}, nil
+}
+
+// closeSyncer releases the clients held by the source and locker of `syncer`
+func closeSyncer(syncer *targetsync.Syncer) {
+	closeAll(syncer.Src, syncer.Locker)
+}
+
+// closeAll closes each of `objs` which is an `io.Closer` (once, as the source
+// may also be the locker)
+func closeAll(objs ...interface{}) {
+	closed := make([]io.Closer, 0, len(objs))
+outer:
+	for _, obj := range objs {
+		c, ok := obj.(io.Closer)
+		if !ok {
+			continue
+		}
+		for _, prev := range closed {
+			if prev == c {
+				continue outer
+			}
+		}
+		closed = append(closed, c)
+		if err := c.Close(); err != nil {
+			logrus.Warnf("Error closing %T: %v", c, err)
+		}
+	}
+}
+
+// newLocker creates the locker configured in `cfg`, falling back to the locking of `src`
+func newLocker(cfg *targetsync.LockConfig, src targetsync.TargetSource) (targetsync.Locker, error) {
+	switch cfg.Type {
+	case targetsync.LockTypeConsul:
+		locker, err := targetsync.NewConsulLocker(&cfg.Consul)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating consul locker: %v", err)
+		}
+		return locker, nil
+	case targetsync.LockTypeKubernetes:
+		locker, err := targetsync.NewK8sLeaseLocker(&cfg.Kubernetes)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating kubernetes lease locker: %v", err)
+		}
+		return locker, nil
+	case targetsync.LockTypeEtcd:
+		locker, err := targetsync.NewEtcdLocker(&cfg.Etcd)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating etcd locker: %v", err)
+		}
+		return locker, nil
+	case targetsync.LockTypeFile:
+		locker, err := targetsync.NewFileLocker(&cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating file locker: %v", err)
+		}
+		return locker, nil
+	case targetsync.LockTypeNone:
+		return targetsync.NopLocker{}, nil
+	default:
+		locker, ok := src.(targetsync.Locker)
+		if !ok {
+			return nil, fmt.Errorf("Source doesn't support locking, a lock type must be configured")
+		}
+		return locker, nil
+	}
+}
+
+// supervisor runs a Syncer per pipeline, restarting any that fail without
+// affecting the others
+type supervisor struct {
+	LocalAddr string
+	// newSyncer creates the syncer of a pipeline, defaults to `newSyncer`
+	newSyncer func(context.Context, *targetsync.PipelineConfig, string) (*targetsync.Syncer, error)
+
+	l       sync.RWMutex
+	syncers map[string]*targetsync.Syncer
+}
+
+// Started returns whether every pipeline has a started syncer
+func (s *supervisor) Started(pipelines []*targetsync.PipelineConfig) bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	for _, p := range pipelines {
+		syncer, ok := s.syncers[p.Name]
+		if !ok || !syncer.Status().Started {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the status of all running pipelines
+func (s *supervisor) Status() []targetsync.SyncerStatus {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	statuses := make([]targetsync.SyncerStatus, 0, len(s.syncers))
+	for _, syncer := range s.syncers {
+		statuses = append(statuses, syncer.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// DryRunChanges returns the changes each dry-run pipeline would have made
+func (s *supervisor) DryRunChanges() map[string][]targetsync.DryRunChange {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	changes := make(map[string][]targetsync.DryRunChange)
+	for name, syncer := range s.syncers {
+		if c := syncer.DryRunChanges(); c != nil {
+			changes[name] = c
+		}
+	}
+	return changes
+}
+
+// TargetHealth returns the health of the targets at the destinations of each pipeline
+func (s *supervisor) TargetHealth(ctx context.Context) map[string][]*targetsync.DestinationHealth {
+	s.l.RLock()
+	syncers := make(map[string]*targetsync.Syncer, len(s.syncers))
+	for name, syncer := range s.syncers {
+		syncers[name] = syncer
+	}
+	s.l.RUnlock()
+
+	// Don't hold the lock while waiting on the destinations
+	health := make(map[string][]*targetsync.DestinationHealth, len(syncers))
+	for name, syncer := range syncers {
+		health[name] = syncer.TargetHealth(ctx)
+	}
+	return health
+}
+
+// Run runs all `pipelines` until the context is done
+func (s *supervisor) Run(ctx context.Context, pipelines []*targetsync.PipelineConfig) {
+	s.l.Lock()
+	s.syncers = make(map[string]*targetsync.Syncer, len(pipelines))
+	s.l.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range pipelines {
+		wg.Add(1)
+		go func(p *targetsync.PipelineConfig) {
+			defer wg.Done()
+			s.runPipeline(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// runPipeline runs a single pipeline, restarting it on failure
+func (s *supervisor) runPipeline(ctx context.Context, cfg *targetsync.PipelineConfig) {
+	log := logrus.WithField("pipeline", cfg.Name)
+	create := s.newSyncer
+	if create == nil {
+		create = newSyncer
+	}
+	for {
+		syncer, err := create(ctx, cfg, s.LocalAddr)
+		if err == nil {
+			s.l.Lock()
+			s.syncers[cfg.Name] = syncer
+			s.l.Unlock()
+
+			log.Infof("Starting pipeline")
+			err = syncer.Run(ctx)
+			closeSyncer(syncer)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Errorf("Pipeline failed, restarting in %v: %v", restartDelay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wish/targetsync"
+)
+
+// testSource sends `targets` once subscribed. If `broken` it can't be locked
+// so that the syncer fails
+type testSource struct {
+	targets []*targetsync.Target
+	broken  bool
+	closes  *int64
+}
+
+func (s *testSource) Subscribe(ctx context.Context) (chan []*targetsync.Target, error) {
+	ch := make(chan []*targetsync.Target, 1)
+	ch <- s.targets
+	return ch, nil
+}
+
+func (s *testSource) Lock(ctx context.Context, opts *targetsync.LockOptions) (<-chan bool, error) {
+	if s.broken {
+		return nil, errors.New("lock unavailable")
+	}
+	ch := make(chan bool, 1)
+	ch <- true
+	return ch, nil
+}
+
+func (s *testSource) Close() error {
+	atomic.AddInt64(s.closes, 1)
+	return nil
+}
+
+// testDestination records the targets added to it
+type testDestination struct {
+	l       sync.Mutex
+	targets []*targetsync.Target
+}
+
+func (d *testDestination) GetTargets(context.Context) ([]*targetsync.Target, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return append([]*targetsync.Target(nil), d.targets...), nil
+}
+
+func (d *testDestination) AddTargets(_ context.Context, targets []*targetsync.Target) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.targets = append(d.targets, targets...)
+	return nil
+}
+
+func (d *testDestination) RemoveTargets(context.Context, []*targetsync.Target) error {
+	return nil
+}
+
+func (d *testDestination) count() int {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return len(d.targets)
+}
+
+// TestSupervisor checks that a failing pipeline is restarted (closing its
+// source each time) without affecting the others
+func TestSupervisor(t *testing.T) {
+	restartDelay = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var goodCloses, brokenCloses, brokenStarts int64
+	dst := &testDestination{}
+	sup := &supervisor{
+		newSyncer: func(_ context.Context, cfg *targetsync.PipelineConfig, _ string) (*targetsync.Syncer, error) {
+			src := &testSource{targets: []*targetsync.Target{{IP: "10.0.0.1", Port: 80}}, closes: &goodCloses}
+			dsts := map[string]targetsync.TargetDestination{"a": dst}
+			if cfg.Name == "broken" {
+				atomic.AddInt64(&brokenStarts, 1)
+				src = &testSource{broken: true, closes: &brokenCloses}
+				dsts = map[string]targetsync.TargetDestination{"a": &testDestination{}}
+			}
+			return &targetsync.Syncer{
+				Name:   cfg.Name,
+				Config: &cfg.SyncConfig,
+				Locker: src,
+				Src:    src,
+				Dsts:   dsts,
+			}, nil
+		},
+	}
+	pipelines := []*targetsync.PipelineConfig{{Name: "good"}, {Name: "broken"}}
+	for _, p := range pipelines {
+		p.SyncConfig = targetsync.SyncConfig{
+			LockOptions: targetsync.LockOptions{Key: p.Name, TTL: time.Second},
+			RemoveDelay: time.Second,
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sup.Run(ctx, pipelines)
+		close(done)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// The good pipeline keeps syncing while the broken one is restarted
+	if n := dst.count(); n != 1 {
+		t.Fatalf("Expected the good pipeline to add its target, got %d targets", n)
+	}
+	if starts := atomic.LoadInt64(&brokenStarts); starts < 3 {
+		t.Fatalf("Expected the broken pipeline to be restarted, got %d starts", starts)
+	}
+	// The source is also the locker, but is only closed once per run
+	if starts, closes := atomic.LoadInt64(&brokenStarts), atomic.LoadInt64(&brokenCloses); closes < starts-1 || closes > starts {
+		t.Fatalf("Expected the broken source to be closed once per run, got %d closes for %d starts", closes, starts)
+	}
+	if closes := atomic.LoadInt64(&goodCloses); closes != 0 {
+		t.Fatalf("Expected the good source to still be open, got %d closes", closes)
+	}
+	if !sup.Started(pipelines[:1]) {
+		t.Fatalf("Expected the good pipeline to be started")
+	}
+
+	// Sources are closed once their pipeline stops
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the supervisor to stop")
+	}
+	if closes := atomic.LoadInt64(&goodCloses); closes != 1 {
+		t.Fatalf("Expected the good source to be closed, got %d closes", closes)
+	}
+}
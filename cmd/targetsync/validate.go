@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/wish/targetsync"
+)
+
+// runValidate loads and validates the config at `path`, printing all problems found
+func runValidate(path string) int {
+	_, err := targetsync.ConfigFromFile(path)
+	if err == nil {
+		fmt.Printf("%s: OK\n", path)
+		return exitOK
+	}
+
+	if errs, ok := err.(targetsync.ValidationErrors); ok {
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s) found:\n", path, len(errs))
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "  - %v\n", e)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+	}
+	return exitError
+}
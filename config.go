@@ -3,21 +3,21 @@ package targetsync
 import (
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
-	consulApi "github.com/hashicorp/consul/api"
-
+	"github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
 // ConfigFromFile Loads a config file from `path`
 func ConfigFromFile(path string) (*Config, error) {
 	// load the config file
-	cfg := &Config{
-		ConsulConfig: ConsulConfig{
-			ClientConfig: consulApi.DefaultConfig(),
-		},
-	}
+	cfg := &Config{}
 	configBytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("Error loading config: %v", err)
@@ -36,28 +36,638 @@ func ConfigFromFile(path string) (*Config, error) {
 
 // Config for the targetsync
 type Config struct {
-	ConsulConfig       `yaml:"consul"`
-	AWSConfig          `yaml:"aws"`
-	K8sEndpointsConfig `yaml:"k8s_enpoints"`
+	// Default is the single pipeline to run if no `Pipelines` are defined
+	Default PipelineConfig `yaml:",inline"`
 
-	SyncConfig `yaml:"syncer"`
+	// Pipelines are the named pipelines to run in this process
+	Pipelines []*PipelineConfig `yaml:"pipelines"`
+}
+
+// ValidationErrors is the list of all problems found when validating a config
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add adds `err` (flattening any nested ValidationErrors) prefixed by `prefix`
+func (e *ValidationErrors) add(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	if nested, ok := err.(ValidationErrors); ok {
+		for _, n := range nested {
+			e.add(prefix, n)
+		}
+		return
+	}
+	if prefix != "" {
+		err = fmt.Errorf("%s: %v", prefix, err)
+	}
+	*e = append(*e, err)
+}
+
+// addf adds a formatted error
+func (e *ValidationErrors) addf(format string, args ...interface{}) {
+	*e = append(*e, fmt.Errorf(format, args...))
+}
+
+// err returns the errors as an `error`, or nil if there are none
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
 }
 
+// Validate checks the config (and all pipelines within it) for errors. All
+// problems are returned as ValidationErrors
 func (c *Config) Validate() error {
-	return c.SyncConfig.Validate()
+	var errs ValidationErrors
+	if len(c.Pipelines) > 0 && (c.Default.sourceCount() > 0 || len(c.Default.AWSConfig.GetTargetGroups()) > 0) {
+		errs.addf("pipelines can't be combined with a top-level source or destination")
+	}
+
+	names := make(map[string]struct{})
+	lockKeys := make(map[string]struct{})
+	for i, p := range c.GetPipelines() {
+		prefix := fmt.Sprintf("pipeline %q", p.Name)
+		if p.Name == "" {
+			prefix = fmt.Sprintf("pipeline %d", i)
+		}
+		if _, ok := names[p.Name]; ok {
+			errs.addf("duplicate pipeline name %q", p.Name)
+		}
+		names[p.Name] = struct{}{}
+		if _, ok := lockKeys[p.SyncConfig.LockOptions.Key]; ok {
+			errs.addf("%s: duplicate lock key %q", prefix, p.SyncConfig.LockOptions.Key)
+		}
+		lockKeys[p.SyncConfig.LockOptions.Key] = struct{}{}
+		errs.add(prefix, p.Validate())
+	}
+	return errs.err()
+}
+
+// GetPipelines returns the pipelines defined in the config. If no `Pipelines`
+// are defined the top-level config is returned as the single "default" pipeline
+func (c *Config) GetPipelines() []*PipelineConfig {
+	if len(c.Pipelines) > 0 {
+		return c.Pipelines
+	}
+	if c.Default.Name == "" {
+		c.Default.Name = "default"
+	}
+	return []*PipelineConfig{&c.Default}
+}
+
+// PipelineConfig holds the configuration for syncing a single source to a single destination
+type PipelineConfig struct {
+	Name string `yaml:"name"`
+
+	ConsulConfig            `yaml:"consul"`
+	AWSConfig               `yaml:"aws"`
+	K8sEndpointsConfig      `yaml:"k8s_enpoints"`
+	K8sEndpointSlicesConfig `yaml:"k8s_endpoint_slices"`
+	EtcdConfig              `yaml:"etcd"`
+	FileConfig              `yaml:"file"`
+	DNSConfig               `yaml:"dns"`
+
+	LockConfig `yaml:"lock"`
+
+	SyncConfig `yaml:"syncer"`
+}
+
+// sourceCount returns the number of sources configured in the pipeline
+func (c *PipelineConfig) sourceCount() int {
+	count := 0
+	if c.ConsulConfig.ServiceName != "" {
+		count++
+	}
+	if c.K8sEndpointsConfig.Name != "" {
+		count++
+	}
+	if c.K8sEndpointSlicesConfig.ServiceName != "" {
+		count++
+	}
+	if c.EtcdConfig.Prefix != "" {
+		count++
+	}
+	if c.FileConfig.Path != "" {
+		count++
+	}
+	if c.DNSConfig.Name != "" {
+		count++
+	}
+	return count
+}
+
+// sourceLocks returns whether the source configured can also be used for locking
+func (c *PipelineConfig) sourceLocks() bool {
+	return c.FileConfig.Path == "" && c.DNSConfig.Name == ""
+}
+
+// Validate checks the pipeline for errors
+func (c *PipelineConfig) Validate() error {
+	var errs ValidationErrors
+	if c.Name == "" {
+		errs.addf("name must be set")
+	}
+
+	switch c.sourceCount() {
+	case 0:
+		errs.addf("a source must be configured (consul, k8s_enpoints, k8s_endpoint_slices, etcd, file or dns)")
+	case 1:
+	default:
+		errs.addf("only one source may be configured")
+	}
+	if c.ConsulConfig.ServiceName != "" {
+		errs.add("consul", c.ConsulConfig.Validate())
+	}
+	if c.K8sEndpointsConfig.Name != "" {
+		errs.add("k8s_enpoints", c.K8sEndpointsConfig.Validate())
+	}
+	if c.K8sEndpointSlicesConfig.ServiceName != "" {
+		errs.add("k8s_endpoint_slices", c.K8sEndpointSlicesConfig.Validate())
+	}
+	if c.EtcdConfig.Prefix != "" {
+		errs.add("etcd", c.EtcdConfig.Validate())
+	}
+	if c.FileConfig.Path != "" {
+		errs.add("file", c.FileConfig.Validate())
+	}
+	if c.DNSConfig.Name != "" {
+		errs.add("dns", c.DNSConfig.Validate())
+	}
+	if c.LockConfig.Type == LockTypeSource && !c.sourceLocks() {
+		errs.addf("lock: type must be set as the source doesn't support locking")
+	}
+	// The lease timings are only checked against each other when locking
+	if c.SyncConfig.LockOptions.TTL > 0 {
+		switch {
+		case c.LockConfig.Type == LockTypeKubernetes:
+			errs.add("lock: kubernetes", c.LockConfig.Kubernetes.validateTimings(c.SyncConfig.LockOptions.TTL))
+		case c.LockConfig.Type == LockTypeSource && c.sourceCount() == 1 &&
+			(c.K8sEndpointsConfig.Name != "" || c.K8sEndpointSlicesConfig.ServiceName != ""):
+			// The k8s sources lock with the default lease timings
+			errs.add("syncer", (&K8sLeaseConfig{}).validateTimings(c.SyncConfig.LockOptions.TTL))
+		}
+	}
+
+	errs.add("aws", c.AWSConfig.Validate())
+	errs.add("lock", c.LockConfig.Validate())
+	errs.add("syncer", c.SyncConfig.Validate())
+	return errs.err()
+}
+
+// Lock types which can be set in LockConfig
+const (
+	// LockTypeSource uses the locking of the source (the default)
+	LockTypeSource = ""
+	// LockTypeConsul uses a consul lock
+	LockTypeConsul = "consul"
+	// LockTypeKubernetes uses a kubernetes Lease
+	LockTypeKubernetes = "kubernetes"
+	// LockTypeEtcd uses an etcd mutex
+	LockTypeEtcd = "etcd"
+	// LockTypeFile uses an flock on a local file
+	LockTypeFile = "file"
+	// LockTypeNone always acquires the lock, for running a single instance
+	LockTypeNone = "none"
+)
+
+// LockConfig selects the `Locker` used for leader-election, independent of the source
+type LockConfig struct {
+	// Type is the lock backend to use, defaults to the locking of the source
+	Type       string             `yaml:"type"`
+	Consul     ConsulClientConfig `yaml:"consul"`
+	Kubernetes K8sLeaseConfig     `yaml:"kubernetes"`
+	Etcd       EtcdClientConfig   `yaml:"etcd"`
+	File       FileLockConfig     `yaml:"file"`
+}
+
+// Validate checks the lock config for errors
+func (c *LockConfig) Validate() error {
+	var errs ValidationErrors
+	switch c.Type {
+	case LockTypeSource, LockTypeNone:
+	case LockTypeConsul:
+		errs.add("consul", c.Consul.Validate())
+	case LockTypeKubernetes:
+		errs.add("kubernetes", c.Kubernetes.Validate())
+	case LockTypeEtcd:
+		errs.add("etcd", c.Etcd.Validate())
+	case LockTypeFile:
+		errs.add("file", c.File.Validate())
+	default:
+		errs.addf("unknown type %q", c.Type)
+	}
+	return errs.err()
+}
+
+// EtcdConfig holds the configuration for the etcd source
+type EtcdConfig struct {
+	ClientConfig EtcdClientConfig `yaml:"client"`
+	// Prefix is the key prefix the service instances are registered under
+	Prefix string `yaml:"prefix"`
+}
+
+// Validate checks the etcd config for errors
+func (c *EtcdConfig) Validate() error {
+	return c.ClientConfig.Validate()
+}
+
+// EtcdClientConfig holds the options for connecting to etcd
+type EtcdClientConfig struct {
+	Endpoints   []string      `yaml:"endpoints"`
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password"`
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	TLS         EtcdTLSConfig `yaml:"tls"`
+}
+
+// EtcdTLSConfig holds the TLS options for connecting to etcd
+type EtcdTLSConfig struct {
+	ServerName         string `yaml:"server_name"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func (c *EtcdTLSConfig) isSet() bool {
+	return *c != EtcdTLSConfig{}
+}
+
+// Validate checks the etcd client config for errors
+func (c *EtcdClientConfig) Validate() error {
+	var errs ValidationErrors
+	if len(c.Endpoints) == 0 {
+		errs.addf("endpoints must be set")
+	}
+	for _, endpoint := range c.Endpoints {
+		if u, err := url.Parse(endpoint); err != nil || u.Host == "" {
+			errs.addf("endpoint %q must be a URL", endpoint)
+		}
+	}
+	if c.Password != "" && c.Username == "" {
+		errs.addf("password requires username")
+	}
+	if c.DialTimeout < 0 {
+		errs.addf("dial_timeout must not be negative")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs.addf("tls cert_file and key_file must be set together")
+	}
+	return errs.err()
+}
+
+// FileConfig holds the configuration for the file source
+type FileConfig struct {
+	Path string `yaml:"path"`
+	// Format is one of yaml, json or text, defaults to the one matching the
+	// extension of the file (text if it isn't .yaml, .yml or .json)
+	Format string `yaml:"format"`
+	// Port is used for targets without a port
+	Port int `yaml:"port"`
+}
+
+// Validate checks the file config for errors
+func (c *FileConfig) Validate() error {
+	var errs ValidationErrors
+	switch c.Format {
+	case "", FileFormatYAML, FileFormatJSON, FileFormatText:
+	default:
+		errs.addf("format must be yaml, json or text, not %q", c.Format)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs.addf("port %d must be between 1 and 65535", c.Port)
+	}
+	return errs.err()
+}
+
+// FileLockConfig holds the configuration for the file locker
+type FileLockConfig struct {
+	// Directory to create the lock files in
+	Directory string `yaml:"directory"`
+}
+
+// Validate checks the file lock config for errors
+func (c *FileLockConfig) Validate() error {
+	var errs ValidationErrors
+	if c.Directory == "" {
+		errs.addf("directory must be set")
+	}
+	return errs.err()
 }
 
 // ConsulConfig holds the configuration for the consul source
 type ConsulConfig struct {
-	ClientConfig *consulApi.Config `yaml:"client"`
-	ServiceName  string            `yaml:"service_name"`
-	Tag          string            `yaml:"tag"`
+	ClientConfig ConsulClientConfig `yaml:"client"`
+	ServiceName  string             `yaml:"service_name"`
+	Tag          string             `yaml:"tag"`
+}
+
+// Validate checks the consul config for errors
+func (c *ConsulConfig) Validate() error {
+	return c.ClientConfig.Validate()
+}
+
+// ConsulClientConfig holds the options for connecting to consul. Anything unset
+// falls back to the consul defaults (including the CONSUL_* environment variables)
+type ConsulClientConfig struct {
+	Address    string          `yaml:"address"`
+	Scheme     string          `yaml:"scheme"`
+	Datacenter string          `yaml:"datacenter"`
+	Token      string          `yaml:"token"`
+	TokenFile  string          `yaml:"token_file"`
+	Namespace  string          `yaml:"namespace"`
+	TLS        ConsulTLSConfig `yaml:"tls"`
+}
+
+// legacyConsulClientConfig holds the keys of the consul client config which
+// were renamed, they are still accepted but deprecated
+type legacyConsulClientConfig struct {
+	TokenFile string `yaml:"tokenfile"`
+	TLSConfig struct {
+		Address            string `yaml:"address"`
+		CAFile             string `yaml:"cafile"`
+		CAPath             string `yaml:"capath"`
+		CertFile           string `yaml:"certfile"`
+		KeyFile            string `yaml:"keyfile"`
+		InsecureSkipVerify bool   `yaml:"insecureskipverify"`
+	} `yaml:"tlsconfig"`
+}
+
+// UnmarshalYAML accepts the old names of the renamed keys and rejects unknown
+// keys, so that options from an older config aren't silently ignored
+func (c *ConsulClientConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var m map[string]interface{}
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	type plain ConsulClientConfig
+	var raw struct {
+		plain                    `yaml:",inline"`
+		legacyConsulClientConfig `yaml:",inline"`
+	}
+	if err := yaml.UnmarshalStrict(b, &raw); err != nil {
+		return fmt.Errorf("Error unmarshaling consul client config: %v", err)
+	}
+	*c = ConsulClientConfig(raw.plain)
+
+	legacy := raw.legacyConsulClientConfig
+	if legacy == (legacyConsulClientConfig{}) {
+		return nil
+	}
+	logrus.Warnf("The consul client options tokenfile and tlsconfig are deprecated, use token_file and tls instead")
+	set := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	set(&c.TokenFile, legacy.TokenFile)
+	set(&c.TLS.ServerName, legacy.TLSConfig.Address)
+	set(&c.TLS.CAFile, legacy.TLSConfig.CAFile)
+	set(&c.TLS.CAPath, legacy.TLSConfig.CAPath)
+	set(&c.TLS.CertFile, legacy.TLSConfig.CertFile)
+	set(&c.TLS.KeyFile, legacy.TLSConfig.KeyFile)
+	c.TLS.InsecureSkipVerify = c.TLS.InsecureSkipVerify || legacy.TLSConfig.InsecureSkipVerify
+	return nil
+}
+
+// ConsulTLSConfig holds the TLS options for connecting to consul
+type ConsulTLSConfig struct {
+	// ServerName is the SNI host to use, defaults to the host of `Address`
+	ServerName         string `yaml:"server_name"`
+	CAFile             string `yaml:"ca_file"`
+	CAPath             string `yaml:"ca_path"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func (c *ConsulTLSConfig) isSet() bool {
+	return *c != ConsulTLSConfig{}
+}
+
+// Validate checks the consul client config for inconsistent options
+func (c *ConsulClientConfig) Validate() error {
+	var errs ValidationErrors
+	switch c.Scheme {
+	case "", "http", "https":
+	default:
+		errs.addf("scheme must be http or https, not %q", c.Scheme)
+	}
+	if c.Token != "" && c.TokenFile != "" {
+		errs.addf("only one of token and token_file may be set")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs.addf("tls cert_file and key_file must be set together")
+	}
+	if c.Scheme == "http" && c.TLS.isSet() {
+		errs.addf("tls options require the https scheme")
+	}
+	return errs.err()
 }
 
 // AWSConfig holds the configuration for the aws destination
 type AWSConfig struct {
-	TargetGroupARN   string `yaml:"target_group_arn"`
+	AWSTargetGroupConfig `yaml:",inline"`
+	// TargetGroups may be set instead of a single target group to sync the
+	// source to multiple target groups, each reconciled independently
+	TargetGroups []*AWSTargetGroupConfig `yaml:"target_groups"`
+
+	// Region of the target groups, defaults to the region in each ARN
+	Region string `yaml:"region"`
+	// Endpoint overrides the elbv2 API endpoint
+	Endpoint string `yaml:"endpoint"`
+	// Profile is the named profile in the shared config to use for credentials
+	Profile string `yaml:"profile"`
+	// RoleARN is a role to assume (e.g. to manage target groups in another account)
+	RoleARN     string `yaml:"role_arn"`
+	ExternalID  string `yaml:"external_id"`
+	SessionName string `yaml:"session_name"`
+}
+
+// TargetGroupRegion returns the region of the target group `arn`
+func (c *AWSConfig) TargetGroupRegion(arn string) string {
+	if c.Region != "" {
+		return c.Region
+	}
+	// arn:partition:elasticloadbalancing:region:account:targetgroup/name/id
+	if parts := strings.SplitN(arn, ":", 5); len(parts) == 5 {
+		return parts[3]
+	}
+	return ""
+}
+
+// GetTargetGroups returns the configured target groups
+func (c *AWSConfig) GetTargetGroups() []*AWSTargetGroupConfig {
+	if c.TargetGroupARN != "" {
+		return []*AWSTargetGroupConfig{&c.AWSTargetGroupConfig}
+	}
+	return c.TargetGroups
+}
+
+// AWSTargetGroupConfig holds the configuration for a single target group
+type AWSTargetGroupConfig struct {
+	TargetGroupARN string `yaml:"target_group_arn"`
+	// AvailabilityZone (if set) limits the targets managed to this AZ
 	AvailabilityZone string `yaml:"availability_zone"`
+	// Port (if set) is used for all targets instead of the port from the source
+	Port int `yaml:"port"`
+	// VPCID (if set) is checked against the VPC of the target group at startup
+	VPCID string `yaml:"vpc_id"`
+	// AvailabilityZoneCIDRs (if set) register the IP targets in matching CIDRs
+	// in a zone, overriding the zone from the source
+	AvailabilityZoneCIDRs []*AvailabilityZoneCIDR `yaml:"availability_zone_cidrs"`
+}
+
+// AvailabilityZoneCIDR registers the targets in CIDR in AvailabilityZone (e.g.
+// "all" for IPs outside of the VPC)
+type AvailabilityZoneCIDR struct {
+	CIDR             string `yaml:"cidr"`
+	AvailabilityZone string `yaml:"availability_zone"`
+}
+
+// cidrZone returns the zone of the most specific CIDR containing `ip`
+func (c *AWSTargetGroupConfig) cidrZone(ip string) (string, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", false
+	}
+	zone, bits := "", -1
+	for _, m := range c.AvailabilityZoneCIDRs {
+		_, ipNet, err := net.ParseCIDR(m.CIDR)
+		if err != nil || !ipNet.Contains(addr) {
+			continue
+		}
+		if ones, _ := ipNet.Mask.Size(); ones > bits {
+			zone, bits = m.AvailabilityZone, ones
+		}
+	}
+	return zone, bits >= 0
+}
+
+var (
+	// targetGroupARNRegex matches the ARN of an elbv2 target group
+	targetGroupARNRegex = regexp.MustCompile(`^arn:aws[a-z-]*:elasticloadbalancing:[a-z0-9-]+:[0-9]{12}:targetgroup/[a-zA-Z0-9-]{1,32}/[0-9a-f]{16}$`)
+	// roleARNRegex matches the ARN of an IAM role
+	roleARNRegex = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[\w+=,.@/-]+$`)
+	// vpcIDRegex matches the ID of a VPC
+	vpcIDRegex = regexp.MustCompile(`^vpc-[0-9a-f]+$`)
+	// regionRegex matches the name of an AWS region
+	regionRegex = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+)
+
+// Validate checks the aws config for errors
+func (c *AWSConfig) Validate() error {
+	var errs ValidationErrors
+	switch {
+	case c.TargetGroupARN != "" && len(c.TargetGroups) > 0:
+		errs.addf("only one of target_group_arn and target_groups may be set")
+	case c.TargetGroupARN == "" && len(c.TargetGroups) == 0:
+		errs.addf("target_group_arn or target_groups must be set")
+	case c.TargetGroupARN != "":
+		errs.add("", c.AWSTargetGroupConfig.Validate())
+	default:
+		arns := make(map[string]struct{})
+		for i, tg := range c.TargetGroups {
+			if _, ok := arns[tg.TargetGroupARN]; ok {
+				errs.addf("duplicate target group %q", tg.TargetGroupARN)
+			}
+			arns[tg.TargetGroupARN] = struct{}{}
+			errs.add(fmt.Sprintf("target_groups[%d]", i), tg.Validate())
+		}
+	}
+
+	if c.Region != "" && !regionRegex.MatchString(c.Region) {
+		errs.addf("region %q is not a valid region", c.Region)
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs.addf("endpoint %q is not a valid URL", c.Endpoint)
+		}
+	}
+	if c.RoleARN == "" {
+		if c.ExternalID != "" || c.SessionName != "" {
+			errs.addf("external_id and session_name require role_arn")
+		}
+	} else if !roleARNRegex.MatchString(c.RoleARN) {
+		errs.addf("role_arn %q is not a valid role ARN", c.RoleARN)
+	}
+	return errs.err()
+}
+
+// Validate checks the target group config for errors
+func (c *AWSTargetGroupConfig) Validate() error {
+	var errs ValidationErrors
+	if c.TargetGroupARN == "" {
+		errs.addf("target_group_arn must be set")
+	} else if !targetGroupARNRegex.MatchString(c.TargetGroupARN) {
+		errs.addf("target_group_arn %q is not a valid target group ARN", c.TargetGroupARN)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs.addf("port %d must be between 1 and 65535", c.Port)
+	}
+	if c.VPCID != "" && !vpcIDRegex.MatchString(c.VPCID) {
+		errs.addf("vpc_id %q is not a valid VPC ID", c.VPCID)
+	}
+	if c.AvailabilityZone != "" && len(c.AvailabilityZoneCIDRs) > 0 {
+		errs.addf("only one of availability_zone and availability_zone_cidrs may be set")
+	}
+	cidrs := make(map[string]struct{})
+	for i, m := range c.AvailabilityZoneCIDRs {
+		_, ipNet, err := net.ParseCIDR(m.CIDR)
+		if err != nil {
+			errs.addf("availability_zone_cidrs[%d]: cidr %q is invalid: %v", i, m.CIDR, err)
+		} else if _, ok := cidrs[ipNet.String()]; ok {
+			errs.addf("availability_zone_cidrs[%d]: duplicate cidr %q", i, m.CIDR)
+		} else {
+			cidrs[ipNet.String()] = struct{}{}
+		}
+		if m.AvailabilityZone == "" {
+			errs.addf("availability_zone_cidrs[%d]: availability_zone must be set", i)
+		}
+	}
+	return errs.err()
+}
+
+// K8sLeaseConfig holds the configuration for the kubernetes Lease locker
+type K8sLeaseConfig struct {
+	K8sConfig `yaml:"k8s"`
+	Namespace string `yaml:"namespace"`
+	// Identity to hold the lease as, defaults to $POD_NAME (or the hostname)
+	Identity string `yaml:"identity"`
+	// RenewDeadline is how long the leader retries renewing the lease for before giving it up
+	RenewDeadline time.Duration `yaml:"renew_deadline"`
+	// RetryPeriod is how often to retry acquiring or renewing the lease
+	RetryPeriod time.Duration `yaml:"retry_period"`
+}
+
+// Validate checks the k8s lease config for errors
+func (c *K8sLeaseConfig) Validate() error {
+	var errs ValidationErrors
+	errs.add("k8s", c.K8sConfig.Validate())
+	if c.Namespace == "" {
+		errs.addf("namespace must be set")
+	}
+	if c.RenewDeadline < 0 {
+		errs.addf("renew_deadline must not be negative")
+	}
+	if c.RetryPeriod < 0 {
+		errs.addf("retry_period must not be negative")
+	}
+	return errs.err()
 }
 
 type K8sConfig struct {
@@ -65,6 +675,15 @@ type K8sConfig struct {
 	KubeConfigPath string `yaml:"kubeconfig_path"`
 }
 
+// Validate checks the k8s config for errors
+func (c *K8sConfig) Validate() error {
+	var errs ValidationErrors
+	if c.InCluster && c.KubeConfigPath != "" {
+		errs.addf("only one of in_cluster and kubeconfig_path may be set")
+	}
+	return errs.err()
+}
+
 type K8sEndpointsConfig struct {
 	K8sConfig `yaml:"k8s"`
 	Name      string `yaml:"name"`
@@ -72,16 +691,190 @@ type K8sEndpointsConfig struct {
 	Port      int    `yaml:"port"`
 }
 
+// Validate checks the k8s endpoints config for errors
+func (c *K8sEndpointsConfig) Validate() error {
+	var errs ValidationErrors
+	errs.add("k8s", c.K8sConfig.Validate())
+	if c.Namespace == "" {
+		errs.addf("namespace must be set")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs.addf("port %d must be between 1 and 65535", c.Port)
+	}
+	return errs.err()
+}
+
+// K8sEndpointSlicesConfig holds the configuration for the k8s EndpointSlice source
+type K8sEndpointSlicesConfig struct {
+	K8sConfig   `yaml:"k8s"`
+	ServiceName string `yaml:"service_name"`
+	Namespace   string `yaml:"namespace"`
+	// PortName selects the port (by name) from the EndpointSlices, if unset the first port is used
+	PortName string `yaml:"port_name"`
+	// Port overrides the port from the EndpointSlices
+	Port         int           `yaml:"port"`
+	ResyncPeriod time.Duration `yaml:"resync_period"`
+}
+
+// Validate checks the k8s endpoint slices config for errors
+func (c *K8sEndpointSlicesConfig) Validate() error {
+	var errs ValidationErrors
+	errs.add("k8s", c.K8sConfig.Validate())
+	if c.Namespace == "" {
+		errs.addf("namespace must be set")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs.addf("port %d must be between 1 and 65535", c.Port)
+	}
+	if c.ResyncPeriod < 0 {
+		errs.addf("resync_period must be >=0")
+	}
+	return errs.err()
+}
+
 // SyncConfig holds options for the Syncer
 type SyncConfig struct {
 	LockOptions `yaml:"lock_options"`
 
 	RemoveDelay time.Duration `yaml:"remove_delay"`
+
+	// RetryBackoff is the initial delay before retrying a failed sync, this
+	// doubles (with jitter) on each consecutive failure up to MaxRetryBackoff
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff"`
+	// MaxFailures is the number of consecutive failures after which the lock
+	// is released so another replica can take over (0 means never release)
+	MaxFailures int `yaml:"max_failures"`
+
+	// MaxRemoveFraction is the maximum fraction of the destination's targets
+	// which may be removed by a single reconcile (0 means no limit)
+	MaxRemoveFraction float64 `yaml:"max_remove_fraction"`
+	// MinTargets is the minimum number of targets to leave in the destination
+	MinTargets int `yaml:"min_targets"`
+	// PreventEmpty refuses removals which would leave the destination empty
+	PreventEmpty bool `yaml:"prevent_empty"`
+
+	// DryRun only logs and records the changes that would be made to the destination
+	DryRun bool `yaml:"dry_run"`
+
+	// WaitForHealthy defers removals until newly added targets are healthy at
+	// the destination (if the destination reports health)
+	WaitForHealthy bool `yaml:"wait_for_healthy"`
+	// HealthyTimeout is how long to wait for a new target to become healthy
+	// before no longer deferring removals for it (defaults to 5m)
+	HealthyTimeout time.Duration `yaml:"healthy_timeout"`
 }
 
+// retryBackoff returns the delay before retrying after `failures` consecutive
+// failures: exponential backoff with jitter
+func (c *SyncConfig) retryBackoff(failures int) time.Duration {
+	base := c.RetryBackoff
+	if base <= 0 {
+		base = time.Second
+	}
+	max := c.MaxRetryBackoff
+	if max <= 0 {
+		max = time.Minute
+	}
+
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	// Randomize over [d/2, d) so that replicas don't retry in lockstep
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// healthyTimeout returns how long to wait for new targets to become healthy
+func (c *SyncConfig) healthyTimeout() time.Duration {
+	if c.HealthyTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return c.HealthyTimeout
+}
+
+// Validate checks the syncer config for errors
 func (c SyncConfig) Validate() error {
+	var errs ValidationErrors
+	if c.LockOptions.Key == "" {
+		errs.addf("lock_options.key must be set")
+	}
 	if c.LockOptions.TTL <= time.Duration(0) {
-		return fmt.Errorf("TTL for locks must be >0")
+		errs.addf("TTL for locks must be >0")
 	}
-	return nil
+	if c.RemoveDelay < 0 {
+		errs.addf("remove_delay must be >=0")
+	}
+	if c.MaxFailures < 0 {
+		errs.addf("max_failures must be >=0")
+	}
+	if c.RetryBackoff < 0 || c.MaxRetryBackoff < 0 {
+		errs.addf("retry backoffs must be >=0")
+	}
+	if c.MaxRemoveFraction < 0 || c.MaxRemoveFraction > 1 {
+		errs.addf("max_remove_fraction must be between 0 and 1")
+	}
+	if c.MinTargets < 0 {
+		errs.addf("min_targets must be >=0")
+	}
+	if c.HealthyTimeout < 0 {
+		errs.addf("healthy_timeout must be >=0")
+	}
+	return errs.err()
+}
+
+// DNSConfig holds the configuration for the DNS source
+type DNSConfig struct {
+	// Name is the DNS name to resolve
+	Name string `yaml:"name"`
+	// Type is either srv or a (A and AAAA records), defaults to a
+	Type string `yaml:"type"`
+	// Port is used for the targets of A and AAAA records
+	Port int `yaml:"port"`
+	// Servers are the nameservers ("host:port") to query, defaults to the ones
+	// in /etc/resolv.conf
+	Servers []string      `yaml:"servers"`
+	Timeout time.Duration `yaml:"timeout"`
+	// MinInterval and MaxInterval bound the time between resolves, which is
+	// otherwise the lowest TTL of the records
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+}
+
+// Validate checks the DNS config for errors
+func (c *DNSConfig) Validate() error {
+	var errs ValidationErrors
+	switch c.Type {
+	case "", DNSTypeA:
+		if c.Port < 1 || c.Port > 65535 {
+			errs.addf("port %d must be between 1 and 65535", c.Port)
+		}
+	case DNSTypeSRV:
+		if c.Port != 0 {
+			errs.addf("port can't be set for srv records")
+		}
+	default:
+		errs.addf("type must be srv or a, not %q", c.Type)
+	}
+	for _, server := range c.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			errs.addf("server %q must be host:port", server)
+		}
+	}
+	if c.Timeout < 0 {
+		errs.addf("timeout must not be negative")
+	}
+	if c.MinInterval < 0 {
+		errs.addf("min_interval must not be negative")
+	}
+	if c.MaxInterval < 0 {
+		errs.addf("max_interval must not be negative")
+	}
+	if c.MinInterval > 0 && c.MaxInterval > 0 && c.MinInterval > c.MaxInterval {
+		errs.addf("min_interval must not be greater than max_interval")
+	}
+	return errs.err()
 }
@@ -0,0 +1,344 @@
+package targetsync
+
+import (
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestConsulClientConfig_Validate(t *testing.T) {
+	tests := []struct {
+		cfg ConsulClientConfig
+		ok  bool
+	}{
+		{cfg: ConsulClientConfig{}, ok: true},
+		{cfg: ConsulClientConfig{Address: "consul:8501", Scheme: "https", Token: "a"}, ok: true},
+		{cfg: ConsulClientConfig{Scheme: "ftp"}, ok: false},
+		{cfg: ConsulClientConfig{Token: "a", TokenFile: "/a"}, ok: false},
+		{cfg: ConsulClientConfig{TLS: ConsulTLSConfig{CertFile: "/cert"}}, ok: false},
+		{cfg: ConsulClientConfig{Scheme: "http", TLS: ConsulTLSConfig{CAFile: "/ca"}}, ok: false},
+		{cfg: ConsulClientConfig{TLS: ConsulTLSConfig{CAFile: "/ca", CertFile: "/cert", KeyFile: "/key"}}, ok: true},
+	}
+
+	for i, test := range tests {
+		err := test.cfg.Validate()
+		if test.ok != (err == nil) {
+			t.Errorf("%d: unexpected result for %+v: %v", i, test.cfg, err)
+		}
+	}
+}
+
+func TestConsulClientConfig_apiConfig(t *testing.T) {
+	cfg := ConsulClientConfig{
+		Address:    "consul:8501",
+		Datacenter: "dc2",
+		Token:      "token",
+		Namespace:  "ns",
+		TLS: ConsulTLSConfig{
+			CAFile: "/ca",
+		},
+	}
+
+	apiCfg := cfg.apiConfig()
+	if apiCfg.Address != cfg.Address || apiCfg.Datacenter != cfg.Datacenter || apiCfg.Token != cfg.Token || apiCfg.Namespace != cfg.Namespace {
+		t.Fatalf("Mismatch in config expected=%+v actual=%+v", cfg, apiCfg)
+	}
+	if apiCfg.TLSConfig.CAFile != cfg.TLS.CAFile {
+		t.Fatalf("Mismatch in tls config expected=%+v actual=%+v", cfg.TLS, apiCfg.TLSConfig)
+	}
+	if apiCfg.Scheme != "https" {
+		t.Fatalf("Expected tls options to imply https, got %s", apiCfg.Scheme)
+	}
+}
+
+func TestAWSConfig_TargetGroupRegion(t *testing.T) {
+	arn := "arn:aws:elasticloadbalancing:us-west-1:123456789012:targetgroup/my-targets/73e2d6bc24d8a067"
+	cfg := &AWSConfig{}
+	if region := cfg.TargetGroupRegion(arn); region != "us-west-1" {
+		t.Fatalf("Expected region from ARN, got %q", region)
+	}
+	cfg.Region = "eu-west-1"
+	if region := cfg.TargetGroupRegion(arn); region != "eu-west-1" {
+		t.Fatalf("Expected configured region, got %q", region)
+	}
+}
+
+func TestAWSTargetGroupConfig_cidrZone(t *testing.T) {
+	cfg := &AWSTargetGroupConfig{AvailabilityZoneCIDRs: []*AvailabilityZoneCIDR{
+		{CIDR: "10.1.0.0/16", AvailabilityZone: "us-west-1a"},
+		{CIDR: "10.0.0.0/8", AvailabilityZone: "all"},
+		{CIDR: "fd00::/8", AvailabilityZone: "all"},
+	}}
+	tests := map[string]string{
+		"10.1.2.3":    "us-west-1a",
+		"10.2.3.4":    "all",
+		"fd00::1":     "all",
+		"192.168.0.1": "",
+		"not-an-ip":   "",
+	}
+	for ip, expected := range tests {
+		zone, ok := cfg.cidrZone(ip)
+		if zone != expected || ok != (expected != "") {
+			t.Fatalf("Expected zone %q for %s, got %q (%v)", expected, ip, zone, ok)
+		}
+	}
+}
+
+// validPipeline returns a valid pipeline config named `name`
+func validPipeline(name string) PipelineConfig {
+	return PipelineConfig{
+		Name:         name,
+		ConsulConfig: ConsulConfig{ServiceName: "svc"},
+		AWSConfig: AWSConfig{
+			AWSTargetGroupConfig: AWSTargetGroupConfig{
+				TargetGroupARN: "arn:aws:elasticloadbalancing:us-west-1:123456789012:targetgroup/my-targets/73e2d6bc24d8a067",
+			},
+		},
+		SyncConfig: SyncConfig{
+			LockOptions: LockOptions{Key: name, TTL: 10 * time.Second},
+			RemoveDelay: time.Minute,
+		},
+	}
+}
+
+func TestConsulClientConfig_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected ConsulClientConfig
+		ok       bool
+	}{
+		{
+			name:     "current",
+			yaml:     "address: consul:8501\nscheme: https\ntoken_file: /token\ntls:\n  ca_file: /ca\n",
+			expected: ConsulClientConfig{Address: "consul:8501", Scheme: "https", TokenFile: "/token", TLS: ConsulTLSConfig{CAFile: "/ca"}},
+			ok:       true,
+		},
+		{
+			name: "deprecated",
+			yaml: "address: consul:8501\ntokenfile: /token\ntlsconfig:\n  address: consul\n  cafile: /ca\n  insecureskipverify: true\n",
+			expected: ConsulClientConfig{Address: "consul:8501", TokenFile: "/token", TLS: ConsulTLSConfig{
+				ServerName:         "consul",
+				CAFile:             "/ca",
+				InsecureSkipVerify: true,
+			}},
+			ok: true,
+		},
+		{name: "unknown", yaml: "address: consul:8501\nwaittime: 10s\n"},
+		{name: "unknown tls", yaml: "tlsconfig:\n  capem: abc\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cfg ConsulClientConfig
+			err := yaml.Unmarshal([]byte(test.yaml), &cfg)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("Expected an error, got: %+v", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cfg != test.expected {
+				t.Fatalf("Mismatch in config expected=%+v actual=%+v", test.expected, cfg)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func() PipelineConfig { return validPipeline("a") }
+
+	tests := []struct {
+		name   string
+		mutate func(*PipelineConfig)
+		errs   int
+	}{
+		{name: "valid", mutate: func(*PipelineConfig) {}},
+		{name: "no source", mutate: func(c *PipelineConfig) { c.ConsulConfig.ServiceName = "" }, errs: 1},
+		{name: "two sources", mutate: func(c *PipelineConfig) {
+			c.K8sEndpointsConfig = K8sEndpointsConfig{Name: "svc", Namespace: "ns", Port: 80}
+		}, errs: 1},
+		{name: "missing arn", mutate: func(c *PipelineConfig) { c.AWSConfig.TargetGroupARN = "" }, errs: 1},
+		{name: "bad arn", mutate: func(c *PipelineConfig) { c.AWSConfig.TargetGroupARN = "arn:aws:elasticloadbalancing:targetgroup" }, errs: 1},
+		{name: "target groups", mutate: func(c *PipelineConfig) {
+			c.AWSConfig.TargetGroups = []*AWSTargetGroupConfig{
+				{TargetGroupARN: c.AWSConfig.TargetGroupARN, Port: 8080},
+				{TargetGroupARN: "arn:aws:elasticloadbalancing:us-west-1:123456789012:targetgroup/other/73e2d6bc24d8a068", AvailabilityZone: "all"},
+			}
+			c.AWSConfig.TargetGroupARN = ""
+		}},
+		{name: "arn and target groups", mutate: func(c *PipelineConfig) {
+			c.AWSConfig.TargetGroups = []*AWSTargetGroupConfig{{TargetGroupARN: c.AWSConfig.TargetGroupARN}}
+		}, errs: 1},
+		{name: "bad target groups", mutate: func(c *PipelineConfig) {
+			c.AWSConfig.TargetGroups = []*AWSTargetGroupConfig{
+				{TargetGroupARN: c.AWSConfig.TargetGroupARN},
+				{TargetGroupARN: c.AWSConfig.TargetGroupARN, Port: 70000},
+			}
+			c.AWSConfig.TargetGroupARN = ""
+		}, errs: 2},
+		{name: "cross account", mutate: func(c *PipelineConfig) {
+			c.AWSConfig.Region = "eu-west-1"
+			c.AWSConfig.Endpoint = "https://elasticloadbalancing.eu-west-1.amazonaws.com"
+			c.AWSConfig.RoleARN = "arn:aws:iam::123456789012:role/targetsync"
+			c.AWSConfig.ExternalID = "id"
+		}},
+		{name: "bad cross account", mutate: func(c *PipelineConfig) {
+			c.AWSConfig.Region = "west"
+			c.AWSConfig.Endpoint = "elb"
+			c.AWSConfig.SessionName = "name"
+		}, errs: 3},
+		{name: "az cidrs", mutate: func(c *PipelineConfig) {
+			c.AWSConfig.AvailabilityZoneCIDRs = []*AvailabilityZoneCIDR{
+				{CIDR: "10.0.0.0/8", AvailabilityZone: "all"},
+				{CIDR: "10.1.0.0/16", AvailabilityZone: "us-west-1a"},
+			}
+		}},
+		{name: "bad az cidrs", mutate: func(c *PipelineConfig) {
+			c.AWSConfig.AvailabilityZone = "all"
+			c.AWSConfig.AvailabilityZoneCIDRs = []*AvailabilityZoneCIDR{
+				{CIDR: "10.0.0.0/8", AvailabilityZone: "all"},
+				{CIDR: "10.0.0.1/8", AvailabilityZone: "all"},
+				{CIDR: "10.0.0.0", AvailabilityZone: "all"},
+				{CIDR: "10.1.0.0/16"},
+			}
+		}, errs: 4},
+		{name: "kubernetes lock", mutate: func(c *PipelineConfig) {
+			c.LockConfig = LockConfig{Type: LockTypeKubernetes, Kubernetes: K8sLeaseConfig{Namespace: "ns"}}
+		}},
+		{name: "bad kubernetes lock", mutate: func(c *PipelineConfig) {
+			c.LockConfig = LockConfig{Type: LockTypeKubernetes, Kubernetes: K8sLeaseConfig{RenewDeadline: time.Second, RetryPeriod: 2 * time.Second}}
+		}, errs: 2},
+		{name: "short kubernetes lease", mutate: func(c *PipelineConfig) {
+			c.LockConfig = LockConfig{Type: LockTypeKubernetes, Kubernetes: K8sLeaseConfig{Namespace: "ns", RetryPeriod: 5 * time.Second}}
+			c.SyncConfig.LockOptions.TTL = 5 * time.Second
+		}, errs: 2},
+		{name: "short k8s source lease", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.K8sEndpointsConfig = K8sEndpointsConfig{Name: "svc", Namespace: "ns", Port: 80}
+			c.SyncConfig.LockOptions.TTL = 5 * time.Second
+		}, errs: 1},
+		{name: "etcd", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.EtcdConfig = EtcdConfig{ClientConfig: EtcdClientConfig{Endpoints: []string{"http://127.0.0.1:2379"}}, Prefix: "/services/web/"}
+			c.LockConfig = LockConfig{Type: LockTypeEtcd, Etcd: c.EtcdConfig.ClientConfig}
+		}},
+		{name: "bad etcd", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.EtcdConfig = EtcdConfig{ClientConfig: EtcdClientConfig{Endpoints: []string{"127.0.0.1"}, Password: "secret"}, Prefix: "/services/web/"}
+			c.LockConfig = LockConfig{Type: LockTypeEtcd}
+		}, errs: 3},
+		{name: "file", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.FileConfig = FileConfig{Path: "/etc/targetsync/targets.yaml", Port: 80}
+			c.LockConfig = LockConfig{Type: LockTypeNone}
+		}},
+		{name: "bad file", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.FileConfig = FileConfig{Path: "/etc/targetsync/targets", Format: "xml"}
+		}, errs: 2},
+		{name: "dns", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.DNSConfig = DNSConfig{Name: "_http._tcp.example.com", Type: DNSTypeSRV, Servers: []string{"10.0.0.53:53"}}
+			c.LockConfig = LockConfig{Type: LockTypeNone}
+		}},
+		{name: "bad dns", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.DNSConfig = DNSConfig{Name: "example.com", Servers: []string{"10.0.0.53"}, MinInterval: time.Minute, MaxInterval: time.Second}
+		}, errs: 4},
+		{name: "bad file lock", mutate: func(c *PipelineConfig) { c.LockConfig = LockConfig{Type: LockTypeFile} }, errs: 1},
+		{name: "unknown lock", mutate: func(c *PipelineConfig) { c.LockConfig = LockConfig{Type: "zookeeper"} }, errs: 1},
+		{name: "bad port", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.K8sEndpointsConfig = K8sEndpointsConfig{Name: "svc", Namespace: "ns", Port: 70000}
+		}, errs: 1},
+		// only warned about when the syncer starts
+		{name: "short remove delay", mutate: func(c *PipelineConfig) {
+			c.SyncConfig.RemoveDelay = time.Millisecond
+		}},
+		{name: "everything", mutate: func(c *PipelineConfig) {
+			c.ConsulConfig.ServiceName = ""
+			c.AWSConfig.TargetGroupARN = ""
+			c.SyncConfig = SyncConfig{}
+		}, errs: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := valid()
+			test.mutate(&p)
+			cfg := &Config{Default: p}
+			err := cfg.Validate()
+			if test.errs == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			errs, ok := err.(ValidationErrors)
+			if !ok {
+				t.Fatalf("Expected ValidationErrors, got: %v", err)
+			}
+			if len(errs) != test.errs {
+				t.Fatalf("Expected %d errors, got %d: %v", test.errs, len(errs), errs)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidatePipelines(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*Config)
+		errs   int
+	}{
+		{name: "valid", mutate: func(*Config) {}},
+		{name: "duplicate name", mutate: func(c *Config) {
+			c.Pipelines[1].Name = "a"
+		}, errs: 1},
+		{name: "duplicate lock key", mutate: func(c *Config) {
+			c.Pipelines[1].SyncConfig.LockOptions.Key = "a"
+		}, errs: 1},
+		{name: "missing name", mutate: func(c *Config) {
+			c.Pipelines[1].Name = ""
+		}, errs: 1},
+		{name: "top-level source", mutate: func(c *Config) {
+			c.Default.ConsulConfig.ServiceName = "svc"
+		}, errs: 1},
+		{name: "top-level destination", mutate: func(c *Config) {
+			c.Default.AWSConfig.TargetGroupARN = c.Pipelines[0].AWSConfig.TargetGroupARN
+		}, errs: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := validPipeline("a"), validPipeline("b")
+			cfg := &Config{Pipelines: []*PipelineConfig{&a, &b}}
+			test.mutate(cfg)
+			err := cfg.Validate()
+			if test.errs == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			errs, ok := err.(ValidationErrors)
+			if !ok {
+				t.Fatalf("Expected ValidationErrors, got: %v", err)
+			}
+			if len(errs) != test.errs {
+				t.Fatalf("Expected %d errors, got %d: %v", test.errs, len(errs), errs)
+			}
+		})
+	}
+}
+
+func TestConfigFromFile_sample(t *testing.T) {
+	if _, err := ConfigFromFile("cmd/targetsync/config.yaml"); err != nil {
+		t.Fatalf("Sample config is invalid: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package targetsync
 
 import (
 	"context"
+	"fmt"
 
 	consulApi "github.com/hashicorp/consul/api"
 	"github.com/sirupsen/logrus"
@@ -9,8 +10,7 @@ import (
 
 // NewConsulSource returns a new ConsulSource
 func NewConsulSource(cfg *ConsulConfig) (*ConsulSource, error) {
-	consulCfg := consulApi.DefaultConfig()
-	client, err := consulApi.NewClient(consulCfg)
+	client, err := consulApi.NewClient(cfg.ClientConfig.apiConfig())
 	if err != nil {
 		return nil, err
 	}
@@ -22,6 +22,50 @@ func NewConsulSource(cfg *ConsulConfig) (*ConsulSource, error) {
 	}, nil
 }
 
+// apiConfig returns the consul api config, starting from the consul defaults
+func (c *ConsulClientConfig) apiConfig() *consulApi.Config {
+	cfg := consulApi.DefaultConfig()
+	if c.Address != "" {
+		cfg.Address = c.Address
+	}
+	if c.Scheme != "" {
+		cfg.Scheme = c.Scheme
+	}
+	if c.Datacenter != "" {
+		cfg.Datacenter = c.Datacenter
+	}
+	if c.Token != "" {
+		cfg.Token = c.Token
+	}
+	if c.TokenFile != "" {
+		cfg.TokenFile = c.TokenFile
+	}
+	if c.Namespace != "" {
+		cfg.Namespace = c.Namespace
+	}
+	if c.TLS.ServerName != "" {
+		cfg.TLSConfig.Address = c.TLS.ServerName
+	}
+	if c.TLS.CAFile != "" {
+		cfg.TLSConfig.CAFile = c.TLS.CAFile
+	}
+	if c.TLS.CAPath != "" {
+		cfg.TLSConfig.CAPath = c.TLS.CAPath
+	}
+	if c.TLS.CertFile != "" {
+		cfg.TLSConfig.CertFile = c.TLS.CertFile
+		cfg.TLSConfig.KeyFile = c.TLS.KeyFile
+	}
+	if c.TLS.InsecureSkipVerify {
+		cfg.TLSConfig.InsecureSkipVerify = true
+	}
+	// TLS options without an explicit scheme imply https
+	if c.Scheme == "" && c.TLS.isSet() {
+		cfg.Scheme = "https"
+	}
+	return cfg
+}
+
 // ConsulSource is an implementation for talkint to consul for both `TargetSource` and `Locker`
 type ConsulSource struct {
 	cfg          *ConsulConfig
@@ -31,7 +75,26 @@ type ConsulSource struct {
 
 // Lock to implement the Locker interface
 func (s *ConsulSource) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
-	lock, err := s.client.LockOpts(&consulApi.LockOptions{
+	return (&ConsulLocker{client: s.client}).Lock(ctx, opts)
+}
+
+// ConsulLocker is a `Locker` using a consul lock (independent of the source)
+type ConsulLocker struct {
+	client *consulApi.Client
+}
+
+// NewConsulLocker returns a new ConsulLocker
+func NewConsulLocker(cfg *ConsulClientConfig) (*ConsulLocker, error) {
+	client, err := consulApi.NewClient(cfg.apiConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulLocker{client: client}, nil
+}
+
+// Lock to implement the Locker interface
+func (l *ConsulLocker) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
+	lock, err := l.client.LockOpts(&consulApi.LockOptions{
 		Key:        opts.Key,
 		SessionTTL: opts.TTL.String(),
 	})
@@ -67,7 +130,10 @@ func (s *ConsulSource) Lock(ctx context.Context, opts *LockOptions) (<-chan bool
 
 			select {
 			case <-ctx.Done():
-				logrus.Infof("Context done, stopping lock")
+				logrus.Infof("Context done, releasing lock")
+				if err := lock.Unlock(); err != nil {
+					logrus.Errorf("Error releasing lock: %v", err)
+				}
 				return
 			case <-lockCh:
 				logrus.Infof("Lock lost")
@@ -107,14 +173,7 @@ func (s *ConsulSource) Subscribe(ctx context.Context) (chan []*Target, error) {
 			if meta.LastIndex != queryOpts.WaitIndex {
 				targets := make([]*Target, len(services))
 				for i, entry := range services {
-					addr := entry.Node.Address
-					if entry.Service.Address != "" {
-						addr = entry.Service.Address
-					}
-					targets[i] = &Target{
-						IP:   addr,
-						Port: entry.Service.Port,
-					}
+					targets[i] = s.target(entry)
 				}
 				ch <- targets
 			}
@@ -125,3 +184,38 @@ func (s *ConsulSource) Subscribe(ctx context.Context) (chan []*Target, error) {
 
 	return ch, nil
 }
+
+// consulZoneMetaKey is the service (or node) meta key holding the availability zone
+const consulZoneMetaKey = "availability_zone"
+
+// target returns the target for a service `entry` including its metadata. The
+// labels are the node and service meta (service meta wins) along with
+// "consul/node", "consul/datacenter" and a "consul/tag/<tag>" for each tag
+func (s *ConsulSource) target(entry *consulApi.ServiceEntry) *Target {
+	addr := entry.Node.Address
+	if entry.Service.Address != "" {
+		addr = entry.Service.Address
+	}
+
+	labels := make(map[string]string, len(entry.Node.Meta)+len(entry.Service.Meta)+len(entry.Service.Tags)+2)
+	for k, v := range entry.Node.Meta {
+		labels[k] = v
+	}
+	for k, v := range entry.Service.Meta {
+		labels[k] = v
+	}
+	labels["consul/node"] = entry.Node.Node
+	labels["consul/datacenter"] = entry.Node.Datacenter
+	for _, tag := range entry.Service.Tags {
+		labels["consul/tag/"+tag] = "true"
+	}
+
+	return &Target{
+		IP:               addr,
+		Port:             entry.Service.Port,
+		AvailabilityZone: labels[consulZoneMetaKey],
+		Weight:           entry.Service.Weights.Passing,
+		Labels:           labels,
+		Source:           fmt.Sprintf("consul/%s", s.cfg.ServiceName),
+	}
+}
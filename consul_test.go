@@ -0,0 +1,51 @@
+package targetsync
+
+import (
+	"testing"
+
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+func TestConsulSource_Target(t *testing.T) {
+	src := &ConsulSource{cfg: &ConsulConfig{ServiceName: "web"}}
+	entry := &consulApi.ServiceEntry{
+		Node: &consulApi.Node{
+			Node:       "node1",
+			Address:    "10.0.0.1",
+			Datacenter: "dc1",
+			Meta:       map[string]string{consulZoneMetaKey: "us-east-1a", "rack": "r1"},
+		},
+		Service: &consulApi.AgentService{
+			Port:    8080,
+			Tags:    []string{"canary"},
+			Meta:    map[string]string{"rack": "r2"},
+			Weights: consulApi.AgentWeights{Passing: 3, Warning: 1},
+		},
+	}
+
+	target := src.target(entry)
+	if target.Key() != "10.0.0.1:8080" || target.AvailabilityZone != "us-east-1a" || target.Weight != 3 || target.Source != "consul/web" {
+		t.Fatalf("Unexpected target: %+v", target)
+	}
+	expected := map[string]string{
+		consulZoneMetaKey:   "us-east-1a",
+		"rack":              "r2",
+		"consul/node":       "node1",
+		"consul/datacenter": "dc1",
+		"consul/tag/canary": "true",
+	}
+	if len(target.Labels) != len(expected) {
+		t.Fatalf("Unexpected labels: %v", target.Labels)
+	}
+	for k, v := range expected {
+		if target.Labels[k] != v {
+			t.Fatalf("Expected label %s=%s, got labels %v", k, v, target.Labels)
+		}
+	}
+
+	// The service address takes precedence over the node's
+	entry.Service.Address = "10.0.0.2"
+	if target = src.target(entry); target.IP != "10.0.0.2" {
+		t.Fatalf("Expected service address to be used, got %s", target.IP)
+	}
+}
@@ -0,0 +1,256 @@
+package targetsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultDestination is the name given to `Syncer.Dst`
+const defaultDestination = "default"
+
+// DestinationStatus is a snapshot of the state of a single destination of a Syncer
+type DestinationStatus struct {
+	Name                string `json:"name"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	RemovalsBlocked     string `json:"removals_blocked,omitempty"`
+	// Stopped is the error the destination stopped syncing with
+	Stopped string `json:"stopped,omitempty"`
+}
+
+// DestinationError is an error from a single destination of a Syncer
+type DestinationError struct {
+	Destination string
+	Err         error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("destination %s: %v", e.Destination, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// DestinationErrors are the errors from each destination of a Syncer which failed
+type DestinationErrors []*DestinationError
+
+func (e DestinationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is returns whether any of the destination errors is `target`
+func (e DestinationErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns the errors as an error (nil if there are none)
+func (e DestinationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// destination is a single destination of a Syncer along with its state. Each
+// destination is reconciled independently so that one failing doesn't hold up
+// the others
+type destination struct {
+	name     string
+	pipeline string
+	log      *logrus.Entry
+	// dst wrapped with metrics (and dry-run if enabled)
+	dst    TargetDestination
+	mapper TargetMapper
+	health TargetHealthChecker
+	dryRun *dryRunDestination
+
+	// number of consecutive failures to reconcile
+	failures int64
+
+	l sync.RWMutex
+	// reason the last reconcile's removals were blocked (empty if they weren't)
+	removalsBlocked string
+	// error the destination stopped syncing with (nil while it is syncing)
+	stoppedErr error
+	// targets (by key) added which haven't become healthy yet, with when they were added
+	pendingHealthy map[string]time.Time
+}
+
+func newDestination(pipeline, name string, dst TargetDestination, dryRun bool) *destination {
+	d := &destination{
+		name:     name,
+		pipeline: pipeline,
+		log:      logrus.WithFields(logrus.Fields{"pipeline": pipeline, "destination": name}),
+	}
+	d.mapper, _ = dst.(TargetMapper)
+	d.health, _ = dst.(TargetHealthChecker)
+	d.dst = &instrumentedDestination{TargetDestination: dst, pipeline: pipeline, destination: name}
+	if dryRun {
+		d.dryRun = newDryRunDestination(d.dst, d.log, name)
+		d.dst = d.dryRun
+	}
+	return d
+}
+
+// targets returns the targets to register at the destination for `targets` from the source
+func (d *destination) targets(targets []*Target) []*Target {
+	if d.mapper == nil || targets == nil {
+		return targets
+	}
+	return d.mapper.MapTargets(targets)
+}
+
+// consecutiveFailures returns the number of reconciles that have failed in a row
+func (d *destination) consecutiveFailures() int {
+	return int(atomic.LoadInt64(&d.failures))
+}
+
+// failed records a failed reconcile, returning the number of consecutive failures
+func (d *destination) failed() int {
+	failures := atomic.AddInt64(&d.failures, 1)
+	reconcileFailures.WithLabelValues(d.pipeline, d.name).Set(float64(failures))
+	return int(failures)
+}
+
+// succeeded records a successful reconcile
+func (d *destination) succeeded() {
+	d.resetFailures()
+	lastReconcile.Set(d.pipeline, d.name, time.Now())
+}
+
+func (d *destination) resetFailures() {
+	atomic.StoreInt64(&d.failures, 0)
+	reconcileFailures.WithLabelValues(d.pipeline, d.name).Set(0)
+}
+
+// setRemovalsBlocked records why removals are blocked (empty if they aren't)
+func (d *destination) setRemovalsBlocked(reason string) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.removalsBlocked = reason
+	if reason != "" {
+		removalsBlocked.WithLabelValues(d.pipeline, d.name).Set(1)
+	} else {
+		removalsBlocked.WithLabelValues(d.pipeline, d.name).Set(0)
+	}
+}
+
+// setStopped records that the destination stopped syncing due to `err`
+func (d *destination) setStopped(err error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.stoppedErr = err
+}
+
+// stopped returns whether the destination has stopped syncing
+func (d *destination) stopped() bool {
+	d.l.RLock()
+	defer d.l.RUnlock()
+	return d.stoppedErr != nil
+}
+
+func (d *destination) status() DestinationStatus {
+	d.l.RLock()
+	defer d.l.RUnlock()
+	status := DestinationStatus{
+		Name:                d.name,
+		ConsecutiveFailures: d.consecutiveFailures(),
+		RemovalsBlocked:     d.removalsBlocked,
+	}
+	if d.stoppedErr != nil {
+		status.Stopped = d.stoppedErr.Error()
+	}
+	return status
+}
+
+// DestinationHealth is the health of the targets at a destination
+type DestinationHealth struct {
+	Destination string          `json:"destination"`
+	Targets     []*TargetHealth `json:"targets"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// targetHealth fetches the health of the targets at the destination, recording
+// it in the metrics
+func (d *destination) targetHealth(ctx context.Context) ([]*TargetHealth, error) {
+	health, err := d.health.GetTargetHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	targetHealth.Set(d.pipeline, d.name, health)
+	return health, nil
+}
+
+// addPendingHealthy records that `added` are waiting to become healthy. Targets
+// which are no longer in `srcTargets` are no longer waited for
+func (d *destination) addPendingHealthy(added, srcTargets []*Target) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if d.pendingHealthy == nil {
+		d.pendingHealthy = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for _, target := range added {
+		d.pendingHealthy[target.Key()] = now
+	}
+	src := targetMap(srcTargets)
+	for key := range d.pendingHealthy {
+		if _, ok := src[key]; !ok {
+			delete(d.pendingHealthy, key)
+		}
+	}
+}
+
+// awaitingHealthy returns whether removals should be deferred as there are
+// new targets which haven't become healthy within `timeout`
+func (d *destination) awaitingHealthy(ctx context.Context, timeout time.Duration) bool {
+	d.l.RLock()
+	pending := len(d.pendingHealthy)
+	d.l.RUnlock()
+	if d.health == nil || pending == 0 {
+		return false
+	}
+
+	healthy := make(map[string]bool)
+	health, err := d.targetHealth(ctx)
+	if err != nil {
+		// Keep waiting, the timeout still applies
+		d.log.Errorf("Error fetching target health: %v", err)
+	}
+	for _, h := range health {
+		healthy[h.Target.Key()] = h.Healthy
+	}
+
+	d.l.Lock()
+	defer d.l.Unlock()
+	for key, added := range d.pendingHealthy {
+		if healthy[key] {
+			delete(d.pendingHealthy, key)
+		} else if time.Since(added) > timeout {
+			d.log.Warnf("Target %s didn't become healthy within %v, no longer deferring removals for it", key, timeout)
+			delete(d.pendingHealthy, key)
+		}
+	}
+	if len(d.pendingHealthy) > 0 {
+		d.log.Infof("Deferring removals until %d new targets are healthy", len(d.pendingHealthy))
+		return true
+	}
+	return false
+}
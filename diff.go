@@ -0,0 +1,134 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// TargetDiff is the set of changes required to make a destination match a source
+type TargetDiff struct {
+	// Destination is the name of the destination the diff is for
+	Destination string `json:"destination"`
+	// Add are the targets in the source which are missing from the destination
+	Add []*Target `json:"add"`
+	// Remove are the targets in the destination which are missing from the source
+	Remove []*Target `json:"remove"`
+	// PortMismatches are the IPs present in both with a differing set of ports
+	PortMismatches []*PortMismatch `json:"port_mismatches"`
+}
+
+// PortMismatch is an IP which has different ports in the source and destination
+type PortMismatch struct {
+	IP               string `json:"ip"`
+	SourcePorts      []int  `json:"source_ports"`
+	DestinationPorts []int  `json:"destination_ports"`
+}
+
+// Empty returns whether the source and destination are in sync
+func (d *TargetDiff) Empty() bool {
+	return len(d.Add) == 0 && len(d.Remove) == 0
+}
+
+// DiffTargets returns the changes required to make `dst` match `src`
+func DiffTargets(src, dst []*Target) *TargetDiff {
+	srcMap := targetMap(src)
+	dstMap := targetMap(dst)
+
+	diff := &TargetDiff{
+		Add:            make([]*Target, 0),
+		Remove:         make([]*Target, 0),
+		PortMismatches: make([]*PortMismatch, 0),
+	}
+	for key, target := range srcMap {
+		if _, ok := dstMap[key]; !ok {
+			diff.Add = append(diff.Add, target)
+		}
+	}
+	for key, target := range dstMap {
+		if _, ok := srcMap[key]; !ok {
+			diff.Remove = append(diff.Remove, target)
+		}
+	}
+	sortTargets(diff.Add)
+	sortTargets(diff.Remove)
+
+	srcPorts := portsByIP(srcMap)
+	dstPorts := portsByIP(dstMap)
+	for ip, ports := range srcPorts {
+		if otherPorts, ok := dstPorts[ip]; ok && !intsEqual(ports, otherPorts) {
+			diff.PortMismatches = append(diff.PortMismatches, &PortMismatch{
+				IP:               ip,
+				SourcePorts:      ports,
+				DestinationPorts: otherPorts,
+			})
+		}
+	}
+	sort.Slice(diff.PortMismatches, func(i, j int) bool {
+		return diff.PortMismatches[i].IP < diff.PortMismatches[j].IP
+	})
+
+	return diff
+}
+
+// Snapshot returns the first set of targets from `src`
+func Snapshot(ctx context.Context, src TargetSource) ([]*Target, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch, err := src.Subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case targets, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("Source subscription closed")
+		}
+		return targets, nil
+	}
+}
+
+// targetMap returns `targets` keyed by `Target.Key()`
+func targetMap(targets []*Target) map[string]*Target {
+	m := make(map[string]*Target, len(targets))
+	for _, target := range targets {
+		m[target.Key()] = target
+	}
+	return m
+}
+
+// portsByIP returns the sorted ports of each IP in `targets`
+func portsByIP(targets map[string]*Target) map[string][]int {
+	ports := make(map[string][]int)
+	for _, target := range targets {
+		ports[target.IP] = append(ports[target.IP], target.Port)
+	}
+	for _, p := range ports {
+		sort.Ints(p)
+	}
+	return ports
+}
+
+func sortTargets(targets []*Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].IP == targets[j].IP {
+			return targets[i].Port < targets[j].Port
+		}
+		return targets[i].IP < targets[j].IP
+	})
+}
+
+func intsEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
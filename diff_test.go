@@ -0,0 +1,31 @@
+package targetsync
+
+import (
+	"testing"
+)
+
+func TestDiffTargets(t *testing.T) {
+	src := []*Target{{IP: "1", Port: 80}, {IP: "2", Port: 80}, {IP: "3", Port: 81}}
+	dst := []*Target{{IP: "1", Port: 80}, {IP: "3", Port: 80}, {IP: "4", Port: 80}}
+
+	diff := DiffTargets(src, dst)
+
+	expectedAdd := []*Target{{IP: "2", Port: 80}, {IP: "3", Port: 81}}
+	if err := equalTargets(expectedAdd, diff.Add); err != nil {
+		t.Fatalf("Mismatch in add err=%v expected=%+v actual=%+v", err, expectedAdd, diff.Add)
+	}
+	expectedRemove := []*Target{{IP: "3", Port: 80}, {IP: "4", Port: 80}}
+	if err := equalTargets(expectedRemove, diff.Remove); err != nil {
+		t.Fatalf("Mismatch in remove err=%v expected=%+v actual=%+v", err, expectedRemove, diff.Remove)
+	}
+	if len(diff.PortMismatches) != 1 || diff.PortMismatches[0].IP != "3" {
+		t.Fatalf("Mismatch in port mismatches: %+v", diff.PortMismatches)
+	}
+	if diff.Empty() {
+		t.Fatalf("Diff should not be empty")
+	}
+
+	if diff := DiffTargets(src, src); !diff.Empty() {
+		t.Fatalf("Diff of the same targets should be empty: %+v", diff)
+	}
+}
@@ -0,0 +1,274 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DNS record types which can be set in DNSConfig
+const (
+	// DNSTypeSRV resolves an SRV record, taking the port of each target from the record
+	DNSTypeSRV = "srv"
+	// DNSTypeA resolves the A and AAAA records of a name, using the configured port
+	DNSTypeA = "a"
+)
+
+const (
+	// defaultDNSMinInterval is the shortest time between resolves if not configured
+	defaultDNSMinInterval = 5 * time.Second
+	// defaultDNSMaxInterval is the longest time between resolves if not configured
+	defaultDNSMaxInterval = 5 * time.Minute
+	// defaultDNSTimeout is the timeout of each DNS query if not configured
+	defaultDNSTimeout = 5 * time.Second
+	// resolvConfPath is where the nameservers are read from if none are configured
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+// DNSSource is a `TargetSource` which periodically resolves a DNS name. The
+// name is re-resolved once the records' TTL expires (within the configured
+// min and max intervals) and targets are only sent when they change
+type DNSSource struct {
+	cfg     *DNSConfig
+	servers []string
+	client  *dns.Client
+}
+
+// NewDNSSource returns a new DNSSource
+func NewDNSSource(cfg *DNSConfig) (*DNSSource, error) {
+	servers := cfg.Servers
+	if len(servers) == 0 {
+		conf, err := dns.ClientConfigFromFile(resolvConfPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading nameservers: %v", err)
+		}
+		for _, server := range conf.Servers {
+			servers = append(servers, server+":"+conf.Port)
+		}
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	return &DNSSource{
+		cfg:     cfg,
+		servers: servers,
+		client:  &dns.Client{Timeout: timeout},
+	}, nil
+}
+
+// Subscribe to implement the `TargetSource` interface
+func (s *DNSSource) Subscribe(ctx context.Context) (chan []*Target, error) {
+	ch := make(chan []*Target, sourceBufferSize)
+
+	go func(ch chan []*Target) {
+		defer close(ch)
+		var last []*Target
+		for {
+			targets, ttl, err := s.resolve(ctx)
+			if err != nil {
+				logrus.Errorf("Error resolving %s: %v", s.cfg.Name, err)
+			} else if last == nil || !reflect.DeepEqual(targets, last) {
+				last = targets
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- targets:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.interval(ttl)):
+			}
+		}
+	}(ch)
+
+	return ch, nil
+}
+
+// interval returns how long to wait before resolving again for records with `ttl`
+func (s *DNSSource) interval(ttl time.Duration) time.Duration {
+	min, max := s.cfg.MinInterval, s.cfg.MaxInterval
+	if min == 0 {
+		min = defaultDNSMinInterval
+	}
+	if max == 0 {
+		max = defaultDNSMaxInterval
+	}
+	if ttl < min {
+		return min
+	}
+	if ttl > max {
+		return max
+	}
+	return ttl
+}
+
+// resolve returns the targets for the name along with the lowest TTL of the
+// records they came from
+func (s *DNSSource) resolve(ctx context.Context) ([]*Target, time.Duration, error) {
+	var targets []*Target
+	var ttl uint32
+	var err error
+	if s.cfg.Type == DNSTypeSRV {
+		targets, ttl, err = s.resolveSRV(ctx)
+	} else {
+		var ips []dns.RR
+		ips, err = s.resolveIPs(ctx, s.cfg.Name, nil)
+		ttl = minTTL(ips)
+		for _, ip := range ips {
+			targets = append(targets, s.target(rrIP(ip), s.cfg.Port))
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Multiple records may resolve to the same target
+	deduped := make([]*Target, 0, len(targets))
+	seen := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		if _, ok := seen[target.Key()]; !ok {
+			seen[target.Key()] = struct{}{}
+			deduped = append(deduped, target)
+		}
+	}
+	sortTargets(deduped)
+	return deduped, time.Duration(ttl) * time.Second, nil
+}
+
+// resolveSRV resolves the SRV record, looking up the IPs of each of its
+// targets (from the additional section if present)
+func (s *DNSSource) resolveSRV(ctx context.Context) ([]*Target, uint32, error) {
+	resp, err := s.query(ctx, s.cfg.Name, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rrs := make([]dns.RR, 0, len(resp.Answer))
+	targets := make([]*Target, 0)
+	for _, rr := range resp.Answer {
+		// A target of "." means the service isn't available
+		srv, ok := rr.(*dns.SRV)
+		if !ok || srv.Target == "." {
+			continue
+		}
+		rrs = append(rrs, srv)
+		ips, err := s.resolveIPs(ctx, srv.Target, resp.Extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		rrs = append(rrs, ips...)
+		for _, ip := range ips {
+			target := s.target(rrIP(ip), int(srv.Port))
+			target.Weight = int(srv.Weight)
+			target.Labels["dns/target"] = srv.Target
+			target.Labels["dns/priority"] = strconv.Itoa(int(srv.Priority))
+			targets = append(targets, target)
+		}
+	}
+	return targets, minTTL(rrs), nil
+}
+
+// resolveIPs returns the A and AAAA records of `name`, taken from `extra` if
+// it has any for the name
+func (s *DNSSource) resolveIPs(ctx context.Context, name string, extra []dns.RR) ([]dns.RR, error) {
+	ips := ipRecords(dns.Fqdn(name), extra)
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := s.query(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		// The answer may follow CNAMEs, so all of its records are for the name
+		ips = append(ips, ipRecords("", resp.Answer)...)
+	}
+	return ips, nil
+}
+
+// query sends a query for `name` to each of the servers until one answers
+func (s *DNSSource) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	var err error
+	for _, server := range s.servers {
+		var resp *dns.Msg
+		resp, _, err = s.client.ExchangeContext(ctx, msg, server)
+		if err == nil && resp.Truncated {
+			// Retry over TCP to get the full response
+			tcp := &dns.Client{Net: "tcp", Timeout: s.client.Timeout}
+			resp, _, err = tcp.ExchangeContext(ctx, msg, server)
+		}
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%s lookup of %s failed: %s", dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no nameservers")
+	}
+	return nil, err
+}
+
+// target returns the target for `ip` and `port`
+func (s *DNSSource) target(ip string, port int) *Target {
+	return &Target{
+		IP:     ip,
+		Port:   port,
+		Labels: make(map[string]string),
+		Source: fmt.Sprintf("dns/%s", s.cfg.Name),
+	}
+}
+
+// ipRecords returns the A and AAAA records for `name` in `rrs` (all of them
+// if `name` is empty)
+func ipRecords(name string, rrs []dns.RR) []dns.RR {
+	ips := make([]dns.RR, 0)
+	for _, rr := range rrs {
+		if name != "" && !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			ips = append(ips, rr)
+		}
+	}
+	return ips
+}
+
+// rrIP returns the IP of an A or AAAA record
+func rrIP(rr dns.RR) string {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A.String()
+	case *dns.AAAA:
+		return r.AAAA.String()
+	}
+	return ""
+}
+
+// minTTL returns the lowest TTL of `rrs` (0 if there are none)
+func minTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,195 @@
+package targetsync
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsStub is a DNS server answering from a set of records which can be changed
+type dnsStub struct {
+	l       sync.Mutex
+	records []string
+	// glue is whether to include A/AAAA records in the additional section of SRV answers
+	glue bool
+}
+
+func (d *dnsStub) setRecords(records ...string) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.records = records
+}
+
+func (d *dnsStub) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	q := req.Question[0]
+	for _, record := range d.records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			panic(err)
+		}
+		hdr := rr.Header()
+		if hdr.Name == q.Name && hdr.Rrtype == q.Qtype {
+			resp.Answer = append(resp.Answer, rr)
+		} else if d.glue && q.Qtype == dns.TypeSRV && (hdr.Rrtype == dns.TypeA || hdr.Rrtype == dns.TypeAAAA) {
+			resp.Extra = append(resp.Extra, rr)
+		}
+	}
+	w.WriteMsg(resp)
+}
+
+// newDNSStub starts a DNS server on a local UDP port, returning its address
+func newDNSStub(t *testing.T, stub *dnsStub) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: stub, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	<-started
+	return conn.LocalAddr().String()
+}
+
+func TestDNSSource_resolve(t *testing.T) {
+	records := []string{
+		"_http._tcp.example.com. 30 IN SRV 10 5 8080 a.example.com.",
+		"_http._tcp.example.com. 60 IN SRV 20 1 8081 b.example.com.",
+		"a.example.com. 20 IN A 10.0.0.1",
+		"b.example.com. 60 IN A 10.0.0.2",
+		"b.example.com. 60 IN AAAA fd00::2",
+		"web.example.com. 300 IN A 10.0.0.3",
+		"web.example.com. 100 IN A 10.0.0.4",
+	}
+	tests := []struct {
+		name     string
+		cfg      DNSConfig
+		glue     bool
+		expected []*Target
+		ttl      time.Duration
+	}{
+		{
+			name: "srv",
+			cfg:  DNSConfig{Name: "_http._tcp.example.com", Type: DNSTypeSRV},
+			expected: []*Target{
+				{IP: "10.0.0.1", Port: 8080, Weight: 5},
+				{IP: "10.0.0.2", Port: 8081, Weight: 1},
+				{IP: "fd00::2", Port: 8081, Weight: 1},
+			},
+			ttl: 20 * time.Second,
+		},
+		{
+			name: "srv with glue",
+			cfg:  DNSConfig{Name: "_http._tcp.example.com", Type: DNSTypeSRV},
+			glue: true,
+			expected: []*Target{
+				{IP: "10.0.0.1", Port: 8080, Weight: 5},
+				{IP: "10.0.0.2", Port: 8081, Weight: 1},
+				{IP: "fd00::2", Port: 8081, Weight: 1},
+			},
+			ttl: 20 * time.Second,
+		},
+		{
+			name:     "a",
+			cfg:      DNSConfig{Name: "web.example.com", Port: 80},
+			expected: []*Target{{IP: "10.0.0.3", Port: 80}, {IP: "10.0.0.4", Port: 80}},
+			ttl:      100 * time.Second,
+		},
+		{
+			name:     "no records",
+			cfg:      DNSConfig{Name: "missing.example.com", Port: 80},
+			expected: []*Target{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &dnsStub{glue: test.glue}
+			stub.setRecords(records...)
+			test.cfg.Servers = []string{newDNSStub(t, stub)}
+			src, err := NewDNSSource(&test.cfg)
+			if err != nil {
+				t.Fatalf("Error creating source: %v", err)
+			}
+
+			targets, ttl, err := src.resolve(context.Background())
+			if err != nil {
+				t.Fatalf("Error resolving: %v", err)
+			}
+			if err := equalTargets(test.expected, targets); err != nil {
+				t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, test.expected, targets)
+			}
+			for i, target := range targets {
+				if target.Weight != test.expected[i].Weight {
+					t.Fatalf("Mismatch in weight of %s expected=%d actual=%d", target.Key(), test.expected[i].Weight, target.Weight)
+				}
+			}
+			if ttl != test.ttl {
+				t.Fatalf("Mismatch in ttl expected=%v actual=%v", test.ttl, ttl)
+			}
+		})
+	}
+}
+
+func TestDNSSource_interval(t *testing.T) {
+	src := &DNSSource{cfg: &DNSConfig{MaxInterval: time.Minute}}
+	tests := map[time.Duration]time.Duration{
+		0:                defaultDNSMinInterval,
+		time.Second:      defaultDNSMinInterval,
+		30 * time.Second: 30 * time.Second,
+		time.Hour:        time.Minute,
+	}
+	for ttl, expected := range tests {
+		if interval := src.interval(ttl); interval != expected {
+			t.Fatalf("Mismatch in interval for ttl=%v expected=%v actual=%v", ttl, expected, interval)
+		}
+	}
+}
+
+func TestDNSSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stub := &dnsStub{}
+	stub.setRecords("web.example.com. 1 IN A 10.0.0.1")
+	src, err := NewDNSSource(&DNSConfig{
+		Name:        "web.example.com",
+		Port:        80,
+		Servers:     []string{newDNSStub(t, stub)},
+		MinInterval: 50 * time.Millisecond,
+		MaxInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Error creating source: %v", err)
+	}
+
+	ch, err := src.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	expected := []*Target{{IP: "10.0.0.1", Port: 80}}
+	if targets := nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+
+	// Nothing is sent while the records are unchanged
+	select {
+	case targets := <-ch:
+		t.Fatalf("Unexpected targets while unchanged: %+v", targets)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Changes are picked up on the next resolve
+	stub.setRecords("web.example.com. 1 IN A 10.0.0.1", "web.example.com. 1 IN A 10.0.0.2")
+	expected = []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "10.0.0.2", Port: 80}}
+	if targets := nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+}
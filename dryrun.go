@@ -0,0 +1,105 @@
+package targetsync
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DryRunChange is a change that would have been made to the destination
+type DryRunChange struct {
+	// Action is either "add" or "remove"
+	Action      string    `json:"action"`
+	Destination string    `json:"destination"`
+	Target      *Target   `json:"target"`
+	Time        time.Time `json:"time"`
+}
+
+// dryRunDestination wraps a TargetDestination, passing through reads but only
+// logging and recording changes
+type dryRunDestination struct {
+	TargetDestination
+	log  *logrus.Entry
+	name string
+
+	l       sync.RWMutex
+	changes map[string]*DryRunChange
+}
+
+func newDryRunDestination(dst TargetDestination, log *logrus.Entry, name string) *dryRunDestination {
+	return &dryRunDestination{
+		TargetDestination: dst,
+		log:               log.WithField("dry_run", true),
+		name:              name,
+		changes:           make(map[string]*DryRunChange),
+	}
+}
+
+// record records `action` for each of `targets`. A change that is repeated
+// (e.g. on each reconcile) keeps the time it was first recorded
+func (d *dryRunDestination) record(action string, targets []*Target) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	now := time.Now()
+	for _, target := range targets {
+		if change, ok := d.changes[target.Key()]; ok && change.Action == action {
+			change.Target = target
+			continue
+		}
+		d.changes[target.Key()] = &DryRunChange{
+			Action:      action,
+			Destination: d.name,
+			Target:      target,
+			Time:        now,
+		}
+	}
+}
+
+// AddTargets records the targets that would have been added
+func (d *dryRunDestination) AddTargets(_ context.Context, targets []*Target) error {
+	d.log.Infof("Would add targets to destination: %v", targets)
+	d.record("add", targets)
+	return nil
+}
+
+// RemoveTargets records the targets that would have been removed
+func (d *dryRunDestination) RemoveTargets(_ context.Context, targets []*Target) error {
+	d.log.Infof("Would remove targets from destination: %v", targets)
+	d.record("remove", targets)
+	return nil
+}
+
+// prune drops the changes which would no longer be made now that the source
+// has `srcTargets`: adds of targets which left the source and removals of
+// targets which are back in it
+func (d *dryRunDestination) prune(srcTargets []*Target) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	src := targetMap(srcTargets)
+	for key, change := range d.changes {
+		_, desired := src[key]
+		if (change.Action == "add") != desired {
+			delete(d.changes, key)
+		}
+	}
+}
+
+// Changes returns the latest change recorded for each target, oldest first
+func (d *dryRunDestination) Changes() []DryRunChange {
+	d.l.RLock()
+	defer d.l.RUnlock()
+	changes := make([]DryRunChange, 0, len(d.changes))
+	for _, change := range d.changes {
+		changes = append(changes, *change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Time.Equal(changes[j].Time) {
+			return changes[i].Target.Key() < changes[j].Target.Key()
+		}
+		return changes[i].Time.Before(changes[j].Time)
+	})
+	return changes
+}
@@ -0,0 +1,165 @@
+package targetsync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const (
+	// instanceCacheTTL is how long an IP to instance mapping is cached for
+	instanceCacheTTL = 5 * time.Minute
+	// maxFilterValues is the most values allowed in a single DescribeInstances filter
+	maxFilterValues = 200
+)
+
+// instanceCache maps private IPs to EC2 instance IDs (and back), caching the
+// results of DescribeInstances
+type instanceCache struct {
+	svc ec2iface.EC2API
+	ttl time.Duration
+
+	l    sync.Mutex
+	byIP map[string]*cachedInstance
+	byID map[string]*cachedInstance
+	// sourceIPs is the IP each instance (by ID) was looked up by, so that it is
+	// mapped back to the IP from the source rather than its primary IP. Unlike
+	// the cache these don't expire
+	sourceIPs map[string]string
+}
+
+type cachedInstance struct {
+	id      string
+	ip      string
+	expires time.Time
+}
+
+func newInstanceCache(svc ec2iface.EC2API) *instanceCache {
+	return &instanceCache{
+		svc:       svc,
+		ttl:       instanceCacheTTL,
+		byIP:      make(map[string]*cachedInstance),
+		byID:      make(map[string]*cachedInstance),
+		sourceIPs: make(map[string]string),
+	}
+}
+
+// InstanceIDs returns the instance ID of each of `ips` keyed by IP. IPs which
+// don't belong to an instance are missing from the result
+func (c *instanceCache) InstanceIDs(ctx context.Context, ips []string) (map[string]string, error) {
+	ids := make(map[string]string, len(ips))
+	missing := c.lookup(ips, c.byIP, func(i *cachedInstance) string { return i.id }, ids)
+	if len(missing) > 0 {
+		if err := c.describe(ctx, "network-interface.addresses.private-ip-address", missing); err != nil {
+			return nil, err
+		}
+		c.lookup(missing, c.byIP, func(i *cachedInstance) string { return i.id }, ids)
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	for ip, id := range ids {
+		c.sourceIPs[id] = ip
+		if i, ok := c.byID[id]; ok {
+			i.ip = ip
+		}
+	}
+	return ids, nil
+}
+
+// IPs returns the private IP of each of `ids` keyed by instance ID. Instances
+// which no longer exist are missing from the result
+func (c *instanceCache) IPs(ctx context.Context, ids []string) (map[string]string, error) {
+	ips := make(map[string]string, len(ids))
+	missing := c.lookup(ids, c.byID, func(i *cachedInstance) string { return i.ip }, ips)
+	if len(missing) > 0 {
+		if err := c.describe(ctx, "instance-id", missing); err != nil {
+			return nil, err
+		}
+		c.lookup(missing, c.byID, func(i *cachedInstance) string { return i.ip }, ips)
+	}
+	return ips, nil
+}
+
+// lookup adds the unexpired entries of `keys` in `m` to `result`, returning
+// the keys which weren't found
+func (c *instanceCache) lookup(keys []string, m map[string]*cachedInstance, value func(*cachedInstance) string, result map[string]string) []string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	now := time.Now()
+	missing := make([]string, 0)
+	for _, key := range keys {
+		if i, ok := m[key]; ok && now.Before(i.expires) {
+			result[key] = value(i)
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// describe looks up the instances matching `values` of `filter` and caches them
+func (c *instanceCache) describe(ctx context.Context, filter string, values []string) error {
+	for len(values) > 0 {
+		batch := values
+		if len(batch) > maxFilterValues {
+			batch = batch[:maxFilterValues]
+		}
+		values = values[len(batch):]
+
+		requested := make(map[string]struct{}, len(batch))
+		for _, v := range batch {
+			requested[v] = struct{}{}
+		}
+		input := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String(filter),
+				Values: aws.StringSlice(batch),
+			}},
+		}
+		err := retryThrottled(ctx, func() error {
+			return c.svc.DescribeInstancesPagesWithContext(ctx, input, func(page *ec2.DescribeInstancesOutput, _ bool) bool {
+				for _, reservation := range page.Reservations {
+					for _, instance := range reservation.Instances {
+						c.add(instance, requested)
+					}
+				}
+				return true
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add caches the IPs of `instance`. If one of its IPs was `requested` (or
+// previously looked up) that is used for the reverse mapping instead of the
+// primary IP
+func (c *instanceCache) add(instance *ec2.Instance, requested map[string]struct{}) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	id := aws.StringValue(instance.InstanceId)
+	ip := aws.StringValue(instance.PrivateIpAddress)
+	ips := make([]string, 0)
+	for _, iface := range instance.NetworkInterfaces {
+		for _, addr := range iface.PrivateIpAddresses {
+			privateIP := aws.StringValue(addr.PrivateIpAddress)
+			ips = append(ips, privateIP)
+			if _, ok := requested[privateIP]; ok || c.sourceIPs[id] == privateIP {
+				ip = privateIP
+			}
+		}
+	}
+
+	expires := time.Now().Add(c.ttl)
+	c.byID[id] = &cachedInstance{id: id, ip: ip, expires: expires}
+	for _, privateIP := range ips {
+		c.byIP[privateIP] = &cachedInstance{id: id, ip: privateIP, expires: expires}
+	}
+}
@@ -3,133 +3,386 @@ package targetsync
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/sirupsen/logrus"
 )
 
-// NewAWSTargetGroup returns a new AWS target group destination
-func NewAWSTargetGroup(cfg *AWSConfig) (*AWSTargetGroup, error) {
-	// TODO: verify that this client is good at creation time (ping or something)
-	sess := session.Must(session.NewSession())
-	return &AWSTargetGroup{
-		svc: elbv2.New(sess),
-		cfg: cfg,
-	}, nil
+const (
+	// maxTargetsPerRequest is the most targets sent in a single register or
+	// deregister call
+	maxTargetsPerRequest = 100
+	// throttleRetries is how many times a throttled request is retried (on
+	// top of the retries done by the sdk)
+	throttleRetries = 5
+)
+
+// throttleBackoff is the initial wait before retrying a throttled request
+var throttleBackoff = time.Second
+
+// NewAWSTargetGroups returns a destination for each target group in the config
+// keyed by target group ARN. If `readOnly` only the permissions to read the
+// targets are verified
+func NewAWSTargetGroups(ctx context.Context, cfg *AWSConfig, readOnly bool) (map[string]TargetDestination, error) {
+	// The target groups may be spread across regions, so we need a client per region
+	type clients struct {
+		svc       elbv2iface.ELBV2API
+		instances *instanceCache
+		perms     *permissionChecker
+	}
+	regions := make(map[string]*clients)
+
+	dsts := make(map[string]TargetDestination)
+	for _, tgCfg := range cfg.GetTargetGroups() {
+		region := cfg.TargetGroupRegion(tgCfg.TargetGroupARN)
+		c, ok := regions[region]
+		if !ok {
+			sess, err := newAWSSession(cfg, region)
+			if err != nil {
+				return nil, fmt.Errorf("Error creating aws session: %v", err)
+			}
+			elbCfg := &aws.Config{}
+			if cfg.Endpoint != "" {
+				elbCfg.Endpoint = aws.String(cfg.Endpoint)
+			}
+			c = &clients{
+				svc:       elbv2.New(sess, elbCfg),
+				instances: newInstanceCache(ec2.New(sess)),
+				perms:     &permissionChecker{sts: sts.New(sess), iam: iam.New(sess)},
+			}
+			regions[region] = c
+		}
+
+		tg := &AWSTargetGroup{
+			svc: c.svc,
+			cfg: tgCfg,
+		}
+		// Fail fast if the target group can't be synced
+		if err := tg.verify(ctx); err != nil {
+			return nil, fmt.Errorf("Error verifying target group %s: %v", tgCfg.TargetGroupARN, err)
+		}
+		if err := c.perms.check(ctx, tg.requiredActions(readOnly), tgCfg.TargetGroupARN); err != nil {
+			return nil, fmt.Errorf("Error verifying permissions for target group %s: %v", tgCfg.TargetGroupARN, err)
+		}
+		if tg.targetType == elbv2.TargetTypeEnumInstance {
+			tg.instances = c.instances
+		}
+		dsts[tgCfg.TargetGroupARN] = tg
+	}
+	return dsts, nil
+}
+
+// defaultSessionName is the session name used when assuming a role
+const defaultSessionName = "targetsync"
+
+// newAWSSession returns a session for `region` using the profile and role in `cfg`
+func newAWSSession(cfg *AWSConfig, region string) (*session.Session, error) {
+	opts := session.Options{
+		Config: aws.Config{
+			Region: aws.String(region),
+		},
+	}
+	if cfg.Profile != "" {
+		opts.Profile = cfg.Profile
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RoleARN != "" {
+		sessionName := cfg.SessionName
+		if sessionName == "" {
+			sessionName = defaultSessionName
+		}
+		creds := stscreds.NewCredentials(sess, cfg.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if cfg.ExternalID != "" {
+				p.ExternalID = aws.String(cfg.ExternalID)
+			}
+		})
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	return sess, nil
 }
 
-// AWSTargetGroup is a TargetDestination implementation for AWS target groups
+// AWSTargetGroup is a TargetDestination implementation for AWS target groups.
+// For "instance" target groups the IPs from the source are mapped to the IDs
+// of the EC2 instances they belong to
 type AWSTargetGroup struct {
-	svc *elbv2.ELBV2
-	cfg *AWSConfig
+	svc        elbv2iface.ELBV2API
+	cfg        *AWSTargetGroupConfig
+	targetType string
+	// maps IPs to instance IDs for "instance" target groups
+	instances *instanceCache
+
+	l sync.Mutex
+	// zone each "ip" target (by key) should be registered in
+	zones map[string]string
+	// zones each "ip" target (by key) is registered in, as of the last GetTargetHealth
+	registered map[string][]string
+	// instance ID each IP was registered as, as of the last GetTargetHealth
+	registeredIDs map[string]string
+}
+
+// registeredID returns the instance ID `ip` was registered as
+func (tg *AWSTargetGroup) registeredID(ip string) (string, bool) {
+	tg.l.Lock()
+	defer tg.l.Unlock()
+	id, ok := tg.registeredIDs[ip]
+	return id, ok
+}
+
+// MapTargets overrides the port of the targets if one is configured and sets
+// the zone each "ip" target should be registered in
+func (tg *AWSTargetGroup) MapTargets(targets []*Target) []*Target {
+	if tg.cfg.Port == 0 {
+		return tg.zoneTargets(targets)
+	}
+	mapped := make([]*Target, 0, len(targets))
+	seen := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		t := target.withPort(tg.cfg.Port)
+		// Multiple ports of the same IP collapse into one target
+		if _, ok := seen[t.Key()]; ok {
+			continue
+		}
+		seen[t.Key()] = struct{}{}
+		mapped = append(mapped, t)
+	}
+	return tg.zoneTargets(mapped)
 }
 
 // GetTargets returns the current set of targets at the destination
 func (tg *AWSTargetGroup) GetTargets(ctx context.Context) ([]*Target, error) {
+	health, err := tg.GetTargetHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Targets in the wrong zone are excluded so that they get registered again
+	wrongZone := tg.wrongZone()
+	targets := make([]*Target, 0, len(health))
+	for _, h := range health {
+		if _, ok := wrongZone[h.Target.Key()]; ok {
+			continue
+		}
+		if h.State != elbv2.TargetHealthStateEnumDraining {
+			targets = append(targets, h.Target)
+		} else {
+			logrus.Debugf("Target %v excluded as it is in state %v", h.Target, h.State)
+		}
+	}
+	return targets, nil
+}
+
+// GetTargetHealth returns the health of each target at the destination
+func (tg *AWSTargetGroup) GetTargetHealth(ctx context.Context) ([]*TargetHealth, error) {
 	input := &elbv2.DescribeTargetHealthInput{
 		TargetGroupArn: aws.String(tg.cfg.TargetGroupARN),
 	}
 
-	result, err := tg.svc.DescribeTargetHealthWithContext(ctx, input)
+	var result *elbv2.DescribeTargetHealthOutput
+	err := retryThrottled(ctx, func() (err error) {
+		result, err = tg.svc.DescribeTargetHealthWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case elbv2.ErrCodeInvalidTargetException:
-				fmt.Println(elbv2.ErrCodeInvalidTargetException, aerr.Error())
-			case elbv2.ErrCodeTargetGroupNotFoundException:
-				fmt.Println(elbv2.ErrCodeTargetGroupNotFoundException, aerr.Error())
-			case elbv2.ErrCodeHealthUnavailableException:
-				fmt.Println(elbv2.ErrCodeHealthUnavailableException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return nil, err
+		return nil, newAWSError("DescribeTargetHealth", err)
 	}
 
 	targets := make([]*Target, 0)
+	health := make([]*TargetHealth, 0)
 	for _, healthDesc := range result.TargetHealthDescriptions {
-		if tg.cfg.AvailabilityZone == "" || *healthDesc.Target.AvailabilityZone == tg.cfg.AvailabilityZone {
-			if state := *healthDesc.TargetHealth.State; state != elbv2.TargetHealthStateEnumDraining {
-				targets = append(targets, &Target{
-					IP:   *healthDesc.Target.Id,
-					Port: int(*healthDesc.Target.Port),
-				})
-			} else {
-				logrus.Debugf("Target %v excluded as it is in state %v", *healthDesc.Target, state)
+		if tg.cfg.AvailabilityZone == "" || aws.StringValue(healthDesc.Target.AvailabilityZone) == tg.cfg.AvailabilityZone {
+			target := &Target{
+				IP:               *healthDesc.Target.Id,
+				Port:             int(aws.Int64Value(healthDesc.Target.Port)),
+				AvailabilityZone: aws.StringValue(healthDesc.Target.AvailabilityZone),
 			}
+			state := aws.StringValue(healthDesc.TargetHealth.State)
+			targets = append(targets, target)
+			health = append(health, &TargetHealth{
+				Target:      target,
+				Healthy:     state == elbv2.TargetHealthStateEnumHealthy,
+				State:       state,
+				Reason:      aws.StringValue(healthDesc.TargetHealth.Reason),
+				Description: aws.StringValue(healthDesc.TargetHealth.Description),
+			})
 		}
 	}
 
-	return targets, nil
+	if tg.instances != nil {
+		mapped, err := tg.instanceTargetsToIPs(ctx, targets)
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range health {
+			h.Target = mapped[i]
+		}
+	}
+	tg.setRegistered(health)
+	return health, nil
+}
+
+// instanceTargetsToIPs maps the instance IDs of `targets` back to IPs. Instances
+// which no longer exist keep their ID so that they can still be removed
+func (tg *AWSTargetGroup) instanceTargetsToIPs(ctx context.Context, targets []*Target) ([]*Target, error) {
+	ids := make([]string, len(targets))
+	for i, target := range targets {
+		ids[i] = target.IP
+	}
+	ips, err := tg.instances.IPs(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Error looking up instances: %v", err)
+	}
+
+	mapped := make([]*Target, len(targets))
+	registeredIDs := make(map[string]string, len(targets))
+	for i, target := range targets {
+		mapped[i] = target
+		if ip, ok := ips[target.IP]; ok {
+			mapped[i] = target.withIP(ip)
+			registeredIDs[ip] = target.IP
+		}
+	}
+	tg.l.Lock()
+	tg.registeredIDs = registeredIDs
+	tg.l.Unlock()
+	return mapped, nil
+}
+
+// ipTargetsToInstances maps the IPs of `targets` to the IDs of the instances
+// they belong to. When adding, targets which don't belong to an instance are
+// skipped. When removing, they fall back to the instance ID they were
+// registered as (from GetTargets). Those without one are returned in an error
+// (along with the rest of the mapped targets) as they would otherwise be left
+// registered
+func (tg *AWSTargetGroup) ipTargetsToInstances(ctx context.Context, targets []*Target, remove bool) ([]*Target, error) {
+	ips := make([]string, len(targets))
+	for i, target := range targets {
+		ips[i] = target.IP
+	}
+	ids, err := tg.instances.InstanceIDs(ctx, ips)
+	if err != nil {
+		return nil, fmt.Errorf("Error looking up instances: %v", err)
+	}
+
+	mapped := make([]*Target, 0, len(targets))
+	missing := make([]string, 0)
+	for _, target := range targets {
+		id, ok := ids[target.IP]
+		if !ok {
+			// Targets whose instance couldn't be found by GetTargets
+			// are already instance IDs
+			switch {
+			case strings.HasPrefix(target.IP, "i-"):
+				id = target.IP
+			case remove:
+				if id, ok = tg.registeredID(target.IP); !ok {
+					missing = append(missing, target.Key())
+					continue
+				}
+			default:
+				logrus.Warnf("Skipping target %s as no instance was found with its IP", target.Key())
+				continue
+			}
+		}
+		mapped = append(mapped, target.withIP(id))
+	}
+	if len(missing) > 0 {
+		return mapped, fmt.Errorf("no instance was found for targets %s", strings.Join(missing, ", "))
+	}
+	return mapped, nil
 }
 
-// AddTargets simply adds the targets described
+// AddTargets simply adds the targets described, in batches of `maxTargetsPerRequest`.
+// Registrations of the targets in other zones are removed once they are added
 func (tg *AWSTargetGroup) AddTargets(ctx context.Context, targets []*Target) error {
+	if tg.instances != nil {
+		var err error
+		if targets, err = tg.ipTargetsToInstances(ctx, targets, false); err != nil {
+			return err
+		}
+	}
+	targets = tg.zoneTargets(targets)
+	for _, batch := range batchTargets(targets, maxTargetsPerRequest) {
+		if err := tg.addTargets(ctx, batch); err != nil {
+			return err
+		}
+	}
+	for _, batch := range batchTargets(tg.staleRegistrations(targets), maxTargetsPerRequest) {
+		if err := tg.removeTargets(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func (tg *AWSTargetGroup) addTargets(ctx context.Context, targets []*Target) error {
 	input := &elbv2.RegisterTargetsInput{
 		TargetGroupArn: aws.String(tg.cfg.TargetGroupARN),
 		Targets:        tg.TargetToTargetDescription(targets),
 	}
 
 	// TODO: check output
-	_, err := tg.svc.RegisterTargetsWithContext(ctx, input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case elbv2.ErrCodeTargetGroupNotFoundException:
-				fmt.Println(elbv2.ErrCodeTargetGroupNotFoundException, aerr.Error())
-			case elbv2.ErrCodeTooManyTargetsException:
-				fmt.Println(elbv2.ErrCodeTooManyTargetsException, aerr.Error())
-			case elbv2.ErrCodeInvalidTargetException:
-				fmt.Println(elbv2.ErrCodeInvalidTargetException, aerr.Error())
-			case elbv2.ErrCodeTooManyRegistrationsForTargetIdException:
-				fmt.Println(elbv2.ErrCodeTooManyRegistrationsForTargetIdException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
+	err := retryThrottled(ctx, func() error {
+		_, err := tg.svc.RegisterTargetsWithContext(ctx, input)
 		return err
+	})
+	if err != nil {
+		return newAWSError("RegisterTargets", err)
 	}
 	return nil
 }
 
-// RemoveTargets simply removes the targets described
+// RemoveTargets simply removes the targets described (in every zone they are
+// registered in), in batches of `maxTargetsPerRequest`
 func (tg *AWSTargetGroup) RemoveTargets(ctx context.Context, targets []*Target) error {
+	// Targets which couldn't be mapped to an instance, the others are still removed
+	var unmapped error
+	if tg.instances != nil {
+		mapped, err := tg.ipTargetsToInstances(ctx, targets, true)
+		if mapped == nil {
+			return err
+		}
+		targets, unmapped = mapped, err
+	}
+	targets = tg.allRegistrations(targets)
+	for _, batch := range batchTargets(targets, maxTargetsPerRequest) {
+		if err := tg.removeTargets(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return unmapped
+}
+
+func (tg *AWSTargetGroup) removeTargets(ctx context.Context, targets []*Target) error {
 	input := &elbv2.DeregisterTargetsInput{
 		TargetGroupArn: aws.String(tg.cfg.TargetGroupARN),
 		Targets:        tg.TargetToTargetDescription(targets),
 	}
 
 	// TODO: check output
-	_, err := tg.svc.DeregisterTargetsWithContext(ctx, input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case elbv2.ErrCodeTargetGroupNotFoundException:
-				fmt.Println(elbv2.ErrCodeTargetGroupNotFoundException, aerr.Error())
-			case elbv2.ErrCodeInvalidTargetException:
-				fmt.Println(elbv2.ErrCodeInvalidTargetException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
+	err := retryThrottled(ctx, func() error {
+		_, err := tg.svc.DeregisterTargetsWithContext(ctx, input)
 		return err
+	})
+	if err != nil {
+		return newAWSError("DeregisterTargets", err)
 	}
 
 	return nil
@@ -143,9 +396,90 @@ func (tg *AWSTargetGroup) TargetToTargetDescription(targets []*Target) []*elbv2.
 			Id:   aws.String(target.IP),
 			Port: aws.Int64(int64(target.Port)),
 		}
-		if tg.cfg.AvailabilityZone != "" {
-			descs[i].AvailabilityZone = aws.String(tg.cfg.AvailabilityZone)
+		// Only IP targets can be registered in a specific AZ
+		if tg.targetType != elbv2.TargetTypeEnumInstance {
+			if target.AvailabilityZone != "" {
+				descs[i].AvailabilityZone = aws.String(target.AvailabilityZone)
+			} else if tg.cfg.AvailabilityZone != "" {
+				descs[i].AvailabilityZone = aws.String(tg.cfg.AvailabilityZone)
+			}
 		}
 	}
 	return descs
 }
+
+// batchTargets splits `targets` into batches of at most `size`
+func batchTargets(targets []*Target, size int) [][]*Target {
+	batches := make([][]*Target, 0, (len(targets)+size-1)/size)
+	for len(targets) > size {
+		batches = append(batches, targets[:size])
+		targets = targets[size:]
+	}
+	if len(targets) > 0 {
+		batches = append(batches, targets)
+	}
+	return batches
+}
+
+// retryThrottled calls `f`, retrying with exponential backoff while the
+// request is throttled
+func retryThrottled(ctx context.Context, f func() error) error {
+	backoff := throttleBackoff
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || !request.IsErrorThrottle(err) || i >= throttleRetries {
+			return err
+		}
+		logrus.Warnf("Request throttled, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// AWSError is an error from the AWS API. Known error codes are classified as
+// one of the destination errors (e.g. ErrInvalidTarget) so that
+// `errors.Is(err, ErrInvalidTarget)` can be used
+type AWSError struct {
+	// Op is the API call which failed
+	Op   string
+	Kind error
+	Err  error
+}
+
+// newAWSError wraps the error `err` from the API call `op`
+func newAWSError(op string, err error) error {
+	e := &AWSError{Op: op, Err: err}
+	if request.IsErrorThrottle(err) {
+		e.Kind = ErrThrottled
+	} else if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case elbv2.ErrCodeTargetGroupNotFoundException:
+			e.Kind = ErrDestinationNotFound
+		case elbv2.ErrCodeTooManyTargetsException, elbv2.ErrCodeTooManyRegistrationsForTargetIdException:
+			e.Kind = ErrTooManyTargets
+		case elbv2.ErrCodeInvalidTargetException:
+			e.Kind = ErrInvalidTarget
+		case elbv2.ErrCodeHealthUnavailableException:
+			e.Kind = ErrHealthUnavailable
+		}
+	}
+	return e
+}
+
+func (e *AWSError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying AWS error
+func (e *AWSError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns whether the error is of the kind `target`
+func (e *AWSError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
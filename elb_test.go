@@ -0,0 +1,550 @@
+package targetsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// mockELBV2 records the register/deregister calls made to it, returning `errs`
+// in order before succeeding
+type mockELBV2 struct {
+	elbv2iface.ELBV2API
+	errs         []error
+	registered   [][]*elbv2.TargetDescription
+	deregistered [][]*elbv2.TargetDescription
+	// targets returned by DescribeTargetHealth
+	targets    []*elbv2.TargetDescription
+	targetType string
+	vpcID      string
+	// health of the targets by ID (healthy if missing)
+	health map[string]*elbv2.TargetHealth
+}
+
+func (m *mockELBV2) nextErr() error {
+	if len(m.errs) == 0 {
+		return nil
+	}
+	err := m.errs[0]
+	m.errs = m.errs[1:]
+	return err
+}
+
+func (m *mockELBV2) RegisterTargetsWithContext(_ aws.Context, input *elbv2.RegisterTargetsInput, _ ...request.Option) (*elbv2.RegisterTargetsOutput, error) {
+	if err := m.nextErr(); err != nil {
+		return nil, err
+	}
+	m.registered = append(m.registered, input.Targets)
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (m *mockELBV2) DeregisterTargetsWithContext(_ aws.Context, input *elbv2.DeregisterTargetsInput, _ ...request.Option) (*elbv2.DeregisterTargetsOutput, error) {
+	if err := m.nextErr(); err != nil {
+		return nil, err
+	}
+	m.deregistered = append(m.deregistered, input.Targets)
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (m *mockELBV2) DescribeTargetGroupsWithContext(_ aws.Context, input *elbv2.DescribeTargetGroupsInput, _ ...request.Option) (*elbv2.DescribeTargetGroupsOutput, error) {
+	return &elbv2.DescribeTargetGroupsOutput{
+		TargetGroups: []*elbv2.TargetGroup{{
+			TargetGroupArn: input.TargetGroupArns[0],
+			TargetType:     aws.String(m.targetType),
+			Protocol:       aws.String(elbv2.ProtocolEnumHttp),
+			Port:           aws.Int64(80),
+			VpcId:          aws.String(m.vpcID),
+		}},
+	}, nil
+}
+
+func (m *mockELBV2) DescribeTargetHealthWithContext(aws.Context, *elbv2.DescribeTargetHealthInput, ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	output := &elbv2.DescribeTargetHealthOutput{}
+	for _, target := range m.targets {
+		health := &elbv2.TargetHealth{State: aws.String(elbv2.TargetHealthStateEnumHealthy)}
+		if h, ok := m.health[aws.StringValue(target.Id)]; ok {
+			health = h
+		}
+		output.TargetHealthDescriptions = append(output.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+			Target:       target,
+			TargetHealth: health,
+		})
+	}
+	return output, nil
+}
+
+// mockEC2 returns `instances` from DescribeInstances (ignoring the filters)
+type mockEC2 struct {
+	ec2iface.EC2API
+	instances []*ec2.Instance
+	calls     int
+}
+
+func (m *mockEC2) DescribeInstancesPagesWithContext(_ aws.Context, _ *ec2.DescribeInstancesInput, f func(*ec2.DescribeInstancesOutput, bool) bool, _ ...request.Option) error {
+	m.calls++
+	f(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: m.instances}},
+	}, true)
+	return nil
+}
+
+func newTestInstance(id string, ips ...string) *ec2.Instance {
+	addrs := make([]*ec2.InstancePrivateIpAddress, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &ec2.InstancePrivateIpAddress{PrivateIpAddress: aws.String(ip)}
+	}
+	return &ec2.Instance{
+		InstanceId:        aws.String(id),
+		PrivateIpAddress:  aws.String(ips[0]),
+		NetworkInterfaces: []*ec2.InstanceNetworkInterface{{PrivateIpAddresses: addrs}},
+	}
+}
+
+func TestAWSTargetGroup_InstanceTargets(t *testing.T) {
+	svc := &mockELBV2{
+		targetType: elbv2.TargetTypeEnumInstance,
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("i-1"), Port: aws.Int64(80)},
+			{Id: aws.String("i-gone"), Port: aws.Int64(80)},
+		},
+	}
+	ec2Svc := &mockEC2{instances: []*ec2.Instance{
+		newTestInstance("i-1", "10.0.0.1"),
+		newTestInstance("i-2", "10.0.0.2", "10.0.0.3"),
+	}}
+	tg := &AWSTargetGroup{svc: svc, cfg: &AWSTargetGroupConfig{}}
+	if err := tg.verify(context.TODO()); err != nil {
+		t.Fatalf("Error verifying target group: %v", err)
+	}
+	if tg.targetType != elbv2.TargetTypeEnumInstance {
+		t.Fatalf("Unexpected target type: %s", tg.targetType)
+	}
+	tg.instances = newInstanceCache(ec2Svc)
+
+	// Instances are mapped back to IPs, unless they no longer exist
+	targets, err := tg.GetTargets(context.TODO())
+	if err != nil {
+		t.Fatalf("Error getting targets: %v", err)
+	}
+	expected := []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "i-gone", Port: 80}}
+	if err := equalTargets(expected, targets); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, targets)
+	}
+
+	// IPs are mapped to instances, including secondary IPs
+	if err := tg.AddTargets(context.TODO(), []*Target{{IP: "10.0.0.3", Port: 80}, {IP: "10.0.0.4", Port: 80}}); err != nil {
+		t.Fatalf("Error adding targets: %v", err)
+	}
+	if len(svc.registered) != 1 || len(svc.registered[0]) != 1 || *svc.registered[0][0].Id != "i-2" {
+		t.Fatalf("Unexpected registrations: %v", svc.registered)
+	}
+
+	// Lookups are cached
+	calls := ec2Svc.calls
+	if _, err := tg.GetTargets(context.TODO()); err != nil {
+		t.Fatalf("Error getting targets: %v", err)
+	}
+	if ec2Svc.calls != calls+1 {
+		t.Fatalf("Expected only the missing instance to be looked up, got %d calls", ec2Svc.calls-calls)
+	}
+}
+
+func TestAWSTargetGroup_RemoveMissingInstance(t *testing.T) {
+	svc := &mockELBV2{
+		targetType: elbv2.TargetTypeEnumInstance,
+		targets:    []*elbv2.TargetDescription{{Id: aws.String("i-1"), Port: aws.Int64(80)}},
+	}
+	ec2Svc := &mockEC2{instances: []*ec2.Instance{newTestInstance("i-1", "10.0.0.1")}}
+	tg := &AWSTargetGroup{svc: svc, cfg: &AWSTargetGroupConfig{}, targetType: elbv2.TargetTypeEnumInstance}
+	tg.instances = newInstanceCache(ec2Svc)
+	tg.instances.ttl = time.Millisecond
+
+	if _, err := tg.GetTargets(context.TODO()); err != nil {
+		t.Fatalf("Error getting targets: %v", err)
+	}
+
+	// The instance is gone (and no longer cached), but is still removed by the
+	// ID it was registered as
+	ec2Svc.instances = nil
+	time.Sleep(10 * time.Millisecond)
+	if err := tg.RemoveTargets(context.TODO(), []*Target{{IP: "10.0.0.1", Port: 80}}); err != nil {
+		t.Fatalf("Error removing targets: %v", err)
+	}
+	if len(svc.deregistered) != 1 || len(svc.deregistered[0]) != 1 || *svc.deregistered[0][0].Id != "i-1" {
+		t.Fatalf("Unexpected deregistrations: %v", svc.deregistered)
+	}
+
+	// An IP which was never registered can't be removed, which is an error
+	// rather than being reported as removed
+	if err := tg.RemoveTargets(context.TODO(), []*Target{{IP: "10.0.0.2", Port: 80}}); err == nil {
+		t.Fatalf("Expected error removing a target without an instance")
+	}
+	if len(svc.deregistered) != 1 {
+		t.Fatalf("Unexpected deregistrations: %v", svc.deregistered)
+	}
+}
+
+func TestInstanceCache_secondaryIP(t *testing.T) {
+	ec2Svc := &mockEC2{instances: []*ec2.Instance{newTestInstance("i-2", "10.0.0.2", "10.0.0.3")}}
+	c := newInstanceCache(ec2Svc)
+	c.ttl = time.Millisecond
+
+	ids, err := c.InstanceIDs(context.TODO(), []string{"10.0.0.3"})
+	if err != nil {
+		t.Fatalf("Error looking up instances: %v", err)
+	}
+	if ids["10.0.0.3"] != "i-2" {
+		t.Fatalf("Unexpected instance IDs: %v", ids)
+	}
+
+	// Once the cache expires the instance still maps back to the IP it was
+	// registered with rather than its primary IP
+	time.Sleep(10 * time.Millisecond)
+	ips, err := c.IPs(context.TODO(), []string{"i-2"})
+	if err != nil {
+		t.Fatalf("Error looking up IPs: %v", err)
+	}
+	if ips["i-2"] != "10.0.0.3" {
+		t.Fatalf("Unexpected IPs: %v", ips)
+	}
+	if ec2Svc.calls != 2 {
+		t.Fatalf("Expected the expired instance to be looked up again, got %d calls", ec2Svc.calls)
+	}
+}
+
+func TestAWSTargetGroup_AddTargets(t *testing.T) {
+	svc := &mockELBV2{}
+	tg := &AWSTargetGroup{svc: svc, cfg: &AWSTargetGroupConfig{}}
+
+	targets := make([]*Target, maxTargetsPerRequest*2+1)
+	for i := range targets {
+		targets[i] = &Target{IP: fmt.Sprintf("10.0.0.%d", i), Port: 80}
+	}
+	if err := tg.AddTargets(context.TODO(), targets); err != nil {
+		t.Fatalf("Error adding targets: %v", err)
+	}
+	if len(svc.registered) != 3 {
+		t.Fatalf("Expected 3 batches, got %d", len(svc.registered))
+	}
+	for i, size := range []int{maxTargetsPerRequest, maxTargetsPerRequest, 1} {
+		if len(svc.registered[i]) != size {
+			t.Fatalf("Expected batch %d to have %d targets, got %d", i, size, len(svc.registered[i]))
+		}
+	}
+}
+
+func TestAWSTargetGroup_Throttling(t *testing.T) {
+	throttleBackoff = time.Millisecond
+
+	throttled := awserr.New("Throttling", "Rate exceeded", nil)
+	svc := &mockELBV2{errs: []error{throttled, throttled}}
+	tg := &AWSTargetGroup{svc: svc, cfg: &AWSTargetGroupConfig{}}
+	if err := tg.AddTargets(context.TODO(), []*Target{{IP: "1", Port: 80}}); err != nil {
+		t.Fatalf("Expected throttled request to be retried: %v", err)
+	}
+
+	// Other errors are returned immediately
+	svc = &mockELBV2{errs: []error{awserr.New(elbv2.ErrCodeInvalidTargetException, "bad target", nil)}}
+	tg = &AWSTargetGroup{svc: svc, cfg: &AWSTargetGroupConfig{}}
+	if err := tg.AddTargets(context.TODO(), []*Target{{IP: "1", Port: 80}}); err == nil {
+		t.Fatalf("Expected error adding targets")
+	}
+}
+
+func TestAWSTargetGroup_verify(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetType string
+		cfg        AWSTargetGroupConfig
+		ok         bool
+	}{
+		{name: "ip", targetType: elbv2.TargetTypeEnumIp, cfg: AWSTargetGroupConfig{AvailabilityZone: "all", VPCID: "vpc-1"}, ok: true},
+		{name: "wrong vpc", targetType: elbv2.TargetTypeEnumIp, cfg: AWSTargetGroupConfig{VPCID: "vpc-2"}},
+		{name: "instance az", targetType: elbv2.TargetTypeEnumInstance, cfg: AWSTargetGroupConfig{AvailabilityZone: "us-west-1a"}},
+		{name: "ip az cidrs", targetType: elbv2.TargetTypeEnumIp, cfg: AWSTargetGroupConfig{AvailabilityZoneCIDRs: []*AvailabilityZoneCIDR{{CIDR: "10.0.0.0/8", AvailabilityZone: "all"}}}, ok: true},
+		{name: "instance az cidrs", targetType: elbv2.TargetTypeEnumInstance, cfg: AWSTargetGroupConfig{AvailabilityZoneCIDRs: []*AvailabilityZoneCIDR{{CIDR: "10.0.0.0/8", AvailabilityZone: "all"}}}},
+		{name: "lambda", targetType: elbv2.TargetTypeEnumLambda},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tg := &AWSTargetGroup{svc: &mockELBV2{targetType: test.targetType, vpcID: "vpc-1"}, cfg: &test.cfg}
+			if err := tg.verify(context.TODO()); test.ok != (err == nil) {
+				t.Fatalf("Unexpected result: %v", err)
+			}
+		})
+	}
+}
+
+// mockSTS returns `arn` as the caller identity, or `err`
+type mockSTS struct {
+	stsiface.STSAPI
+	arn string
+	err error
+}
+
+func (m *mockSTS) GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(m.arn)}, nil
+}
+
+// mockIAM allows only the `allowed` actions and explicitly denies the `denied`
+// ones, or returns `err`
+type mockIAM struct {
+	iamiface.IAMAPI
+	allowed   map[string]bool
+	denied    map[string]bool
+	err       error
+	principal string
+}
+
+func (m *mockIAM) SimulatePrincipalPolicyPagesWithContext(_ aws.Context, input *iam.SimulatePrincipalPolicyInput, f func(*iam.SimulatePolicyResponse, bool) bool, _ ...request.Option) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.principal = *input.PolicySourceArn
+	resp := &iam.SimulatePolicyResponse{}
+	for _, action := range input.ActionNames {
+		decision := iam.PolicyEvaluationDecisionTypeImplicitDeny
+		if m.allowed[*action] {
+			decision = iam.PolicyEvaluationDecisionTypeAllowed
+		} else if m.denied[*action] {
+			decision = iam.PolicyEvaluationDecisionTypeExplicitDeny
+		}
+		resp.EvaluationResults = append(resp.EvaluationResults, &iam.EvaluationResult{
+			EvalActionName: action,
+			EvalDecision:   aws.String(decision),
+		})
+	}
+	f(resp, true)
+	return nil
+}
+
+func TestPermissionChecker(t *testing.T) {
+	tg := &AWSTargetGroup{targetType: elbv2.TargetTypeEnumIp}
+	iamSvc := &mockIAM{
+		allowed: map[string]bool{
+			"elasticloadbalancing:DescribeTargetHealth": true,
+			"elasticloadbalancing:RegisterTargets":      true,
+		},
+		denied: map[string]bool{
+			"elasticloadbalancing:DeregisterTargets": true,
+		},
+	}
+	p := &permissionChecker{
+		sts: &mockSTS{arn: "arn:aws:sts::123456789012:assumed-role/targetsync/session"},
+		iam: iamSvc,
+	}
+
+	err := p.check(context.TODO(), tg.requiredActions(false), "arn")
+	if err == nil || !strings.Contains(err.Error(), "elasticloadbalancing:DeregisterTargets") {
+		t.Fatalf("Expected DeregisterTargets to be denied, got: %v", err)
+	}
+	if iamSvc.principal != "arn:aws:iam::123456789012:role/targetsync" {
+		t.Fatalf("Unexpected principal: %s", iamSvc.principal)
+	}
+
+	// An implicit deny may be allowed by a condition the simulation can't
+	// evaluate, so it is only logged
+	delete(iamSvc.denied, "elasticloadbalancing:DeregisterTargets")
+	if err := p.check(context.TODO(), tg.requiredActions(false), "arn"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	iamSvc.allowed["elasticloadbalancing:DeregisterTargets"] = true
+	if err := p.check(context.TODO(), tg.requiredActions(false), "arn"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Not being able to simulate the policy isn't an error
+	iamSvc.err = awserr.New("AccessDenied", "not allowed", nil)
+	if err := p.check(context.TODO(), []string{"elasticloadbalancing:RegisterTargets"}, "arn"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Neither is not being able to reach STS
+	p = &permissionChecker{
+		sts: &mockSTS{err: awserr.New("RequestError", "send request failed", nil)},
+		iam: &mockIAM{},
+	}
+	if err := p.check(context.TODO(), []string{"elasticloadbalancing:RegisterTargets"}, "arn"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestNewAWSError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{err: awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, "", nil), kind: ErrDestinationNotFound},
+		{err: awserr.New(elbv2.ErrCodeTooManyTargetsException, "", nil), kind: ErrTooManyTargets},
+		{err: awserr.New(elbv2.ErrCodeInvalidTargetException, "", nil), kind: ErrInvalidTarget},
+		{err: awserr.New(elbv2.ErrCodeHealthUnavailableException, "", nil), kind: ErrHealthUnavailable},
+		{err: awserr.New("Throttling", "", nil), kind: ErrThrottled},
+		{err: fmt.Errorf("other")},
+	}
+
+	for i, test := range tests {
+		err := newAWSError("Op", test.err)
+		if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Errorf("%d: expected %v to be %v", i, err, test.kind)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%d: expected %v to wrap %v", i, err, test.err)
+		}
+	}
+}
+
+func TestAWSTargetGroup_GetTargetHealth(t *testing.T) {
+	svc := &mockELBV2{
+		targets: []*elbv2.TargetDescription{
+			{Id: aws.String("10.0.0.1"), Port: aws.Int64(80)},
+			{Id: aws.String("10.0.0.2"), Port: aws.Int64(80)},
+			{Id: aws.String("10.0.0.3"), Port: aws.Int64(80)},
+		},
+		health: map[string]*elbv2.TargetHealth{
+			"10.0.0.2": {
+				State:       aws.String(elbv2.TargetHealthStateEnumUnhealthy),
+				Reason:      aws.String(elbv2.TargetHealthReasonEnumTargetFailedHealthChecks),
+				Description: aws.String("Health checks failed"),
+			},
+			"10.0.0.3": {State: aws.String(elbv2.TargetHealthStateEnumDraining)},
+		},
+	}
+	tg := &AWSTargetGroup{svc: svc, cfg: &AWSTargetGroupConfig{}}
+
+	health, err := tg.GetTargetHealth(context.TODO())
+	if err != nil {
+		t.Fatalf("Error getting target health: %v", err)
+	}
+	if len(health) != 3 || !health[0].Healthy || health[1].Healthy || health[1].Reason != elbv2.TargetHealthReasonEnumTargetFailedHealthChecks || health[1].Description == "" {
+		t.Fatalf("Unexpected health: %+v %+v", health[0], health[1])
+	}
+
+	// Draining targets are excluded from the targets
+	targets, err := tg.GetTargets(context.TODO())
+	if err != nil {
+		t.Fatalf("Error getting targets: %v", err)
+	}
+	expected := []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "10.0.0.2", Port: 80}}
+	if err := equalTargets(expected, targets); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, targets)
+	}
+}
+
+func TestAWSTargetGroup_TargetAvailabilityZone(t *testing.T) {
+	targets := []*Target{
+		{IP: "10.0.0.1", Port: 80, AvailabilityZone: "us-east-1a", Labels: map[string]string{"foo": "bar"}},
+		{IP: "10.0.0.2", Port: 80},
+	}
+
+	// The AZ of each target is used if none is configured
+	tg := &AWSTargetGroup{cfg: &AWSTargetGroupConfig{Port: 8080}, targetType: elbv2.TargetTypeEnumIp}
+	mapped := tg.MapTargets(targets)
+	if mapped[0].Port != 8080 || mapped[0].AvailabilityZone != "us-east-1a" || mapped[0].Labels["foo"] != "bar" {
+		t.Fatalf("Expected metadata to be kept when mapping: %+v", mapped[0])
+	}
+	descs := tg.TargetToTargetDescription(mapped)
+	if aws.StringValue(descs[0].AvailabilityZone) != "us-east-1a" || descs[1].AvailabilityZone != nil {
+		t.Fatalf("Unexpected availability zones: %v %v", descs[0].AvailabilityZone, descs[1].AvailabilityZone)
+	}
+
+	// The configured AZ overrides the targets
+	tg.cfg.AvailabilityZone = "all"
+	descs = tg.TargetToTargetDescription(tg.MapTargets(targets))
+	if aws.StringValue(descs[0].AvailabilityZone) != "all" || aws.StringValue(descs[1].AvailabilityZone) != "all" {
+		t.Fatalf("Unexpected availability zones: %v %v", descs[0].AvailabilityZone, descs[1].AvailabilityZone)
+	}
+
+	// Instance targets are never registered in an AZ
+	tg = &AWSTargetGroup{cfg: &AWSTargetGroupConfig{}, targetType: elbv2.TargetTypeEnumInstance}
+	if descs = tg.TargetToTargetDescription(targets); descs[0].AvailabilityZone != nil {
+		t.Fatalf("Unexpected availability zone for instance target: %v", descs[0].AvailabilityZone)
+	}
+}
+
+func TestAWSTargetGroup_Zones(t *testing.T) {
+	svc := &mockELBV2{
+		targets: []*elbv2.TargetDescription{
+			// Registered in the wrong zone
+			{Id: aws.String("10.0.0.1"), Port: aws.Int64(80), AvailabilityZone: aws.String("us-east-1a")},
+			// Registered in the right zone
+			{Id: aws.String("10.0.0.2"), Port: aws.Int64(80), AvailabilityZone: aws.String("all")},
+			// Zone picked by AWS
+			{Id: aws.String("172.16.0.1"), Port: aws.Int64(80), AvailabilityZone: aws.String("us-east-1b")},
+		},
+	}
+	tg := &AWSTargetGroup{
+		svc: svc,
+		cfg: &AWSTargetGroupConfig{AvailabilityZoneCIDRs: []*AvailabilityZoneCIDR{
+			{CIDR: "10.0.0.0/8", AvailabilityZone: "all"},
+			{CIDR: "10.1.0.0/16", AvailabilityZone: "us-east-1c"},
+		}},
+		targetType: elbv2.TargetTypeEnumIp,
+	}
+
+	src := tg.MapTargets([]*Target{
+		{IP: "10.0.0.1", Port: 80},
+		{IP: "10.0.0.2", Port: 80},
+		{IP: "10.1.0.1", Port: 80, AvailabilityZone: "us-east-1a"},
+		{IP: "172.16.0.1", Port: 80},
+	})
+	expectedZones := []string{"all", "all", "us-east-1c", ""}
+	for i, target := range src {
+		if target.AvailabilityZone != expectedZones[i] {
+			t.Fatalf("Expected %s to be in zone %q, got %q", target.Key(), expectedZones[i], target.AvailabilityZone)
+		}
+	}
+
+	// The target in the wrong zone is missing so that it gets added again
+	dst, err := tg.GetTargets(context.TODO())
+	if err != nil {
+		t.Fatalf("Error getting targets: %v", err)
+	}
+	expected := []*Target{{IP: "10.0.0.2", Port: 80}, {IP: "172.16.0.1", Port: 80}}
+	if err := equalTargets(expected, dst); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, dst)
+	}
+
+	// Adding it registers it in the right zone and removes the old registration
+	diff := DiffTargets(src, dst)
+	if err := tg.AddTargets(context.TODO(), diff.Add); err != nil {
+		t.Fatalf("Error adding targets: %v", err)
+	}
+	zones := make(map[string]string)
+	for _, desc := range svc.registered[0] {
+		zones[aws.StringValue(desc.Id)] = aws.StringValue(desc.AvailabilityZone)
+	}
+	if len(zones) != 2 || zones["10.0.0.1"] != "all" || zones["10.1.0.1"] != "us-east-1c" {
+		t.Fatalf("Unexpected registrations: %v", zones)
+	}
+	if len(svc.deregistered) != 1 || len(svc.deregistered[0]) != 1 || aws.StringValue(svc.deregistered[0][0].AvailabilityZone) != "us-east-1a" {
+		t.Fatalf("Expected only the stale registration to be removed, got %v", svc.deregistered)
+	}
+
+	// Removals use the zone the target is registered in
+	if err := tg.RemoveTargets(context.TODO(), []*Target{dst[1]}); err != nil {
+		t.Fatalf("Error removing targets: %v", err)
+	}
+	if desc := svc.deregistered[1][0]; aws.StringValue(desc.Id) != "172.16.0.1" || aws.StringValue(desc.AvailabilityZone) != "us-east-1b" {
+		t.Fatalf("Unexpected deregistration: %v", desc)
+	}
+}
@@ -2,49 +2,58 @@ package targetsync
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/leaderelection"
-	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 type K8sEndpointsSource struct {
-	clientset       *kubernetes.Clientset
+	clientset       kubernetes.Interface
 	name, namespace string
 	port            int
+	// metadata looks up the pod labels and node zone of each address
+	metadata *k8sMetadataCache
 }
 
 func NewK8sEndpointsSource(cfg *K8sEndpointsConfig) (*K8sEndpointsSource, error) {
+	c, err := newK8sClientset(&cfg.K8sConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &K8sEndpointsSource{
+		clientset: c,
+		name:      cfg.Name,
+		namespace: cfg.Namespace,
+		port:      cfg.Port,
+		metadata:  newK8sMetadataCache(c),
+	}, nil
+}
+
+// newK8sClientset creates a kubernetes clientset from `cfg`
+func newK8sClientset(cfg *K8sConfig) (*kubernetes.Clientset, error) {
 	var config *rest.Config
 	var err error
-	if cfg.K8sConfig.InCluster {
+	if cfg.InCluster {
 		config, err = rest.InClusterConfig()
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		config, err = clientcmd.BuildConfigFromFlags("", cfg.K8sConfig.KubeConfigPath)
+		config, err = clientcmd.BuildConfigFromFlags("", cfg.KubeConfigPath)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	c, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
-
-	return &K8sEndpointsSource{
-		clientset: c,
-		name:      cfg.Name,
-		namespace: cfg.Namespace,
-		port:      cfg.Port,
-	}, nil
+	return kubernetes.NewForConfig(config)
 }
 
 func (s *K8sEndpointsSource) Subscribe(ctx context.Context) (chan []*Target, error) {
@@ -60,17 +69,14 @@ func (s *K8sEndpointsSource) Subscribe(ctx context.Context) (chan []*Target, err
 			}
 			targets := []*Target{}
 
-			ends, err := s.clientset.CoreV1().Endpoints(s.namespace).Get(s.name, metav1.GetOptions{})
+			ends, err := s.clientset.CoreV1().Endpoints(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
 			if err != nil {
 				continue
 			}
 
 			for _, subset := range ends.Subsets {
 				for _, addr := range subset.Addresses {
-					targets = append(targets, &Target{
-						IP:   addr.IP,
-						Port: s.port,
-					})
+					targets = append(targets, s.target(ctx, addr))
 				}
 			}
 			ch <- targets
@@ -80,40 +86,106 @@ func (s *K8sEndpointsSource) Subscribe(ctx context.Context) (chan []*Target, err
 	return ch, nil
 }
 
+// target returns the target for `addr` including its metadata. The labels are
+// the labels of the pod along with "k8s/node" and "k8s/pod"
+func (s *K8sEndpointsSource) target(ctx context.Context, addr corev1.EndpointAddress) *Target {
+	target := &Target{
+		IP:     addr.IP,
+		Port:   s.port,
+		Labels: make(map[string]string),
+		Source: fmt.Sprintf("k8s_endpoints/%s/%s", s.namespace, s.name),
+	}
+	if ref := addr.TargetRef; ref != nil && ref.Kind == "Pod" {
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = s.namespace
+		}
+		for k, v := range s.metadata.podLabels(ctx, namespace, ref.Name) {
+			target.Labels[k] = v
+		}
+		target.Labels["k8s/pod"] = ref.Name
+	}
+	if addr.NodeName != nil && *addr.NodeName != "" {
+		target.Labels["k8s/node"] = *addr.NodeName
+		target.AvailabilityZone = s.metadata.nodeZone(ctx, *addr.NodeName)
+	}
+	return target
+}
+
 func (s *K8sEndpointsSource) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
-	leaseLockName := opts.Key
-	leaseLockNamespace := s.namespace
-
-	lock := &resourcelock.ConfigMapLock{
-		ConfigMapMeta: metav1.ObjectMeta{
-			Name:      leaseLockName,
-			Namespace: leaseLockNamespace,
-		},
-		Client: s.clientset.CoreV1(),
+	return k8sLock(ctx, s.clientset, s.namespace, opts)
+}
+
+// k8sMetadataTTL is how long pod labels and node zones are cached for
+const k8sMetadataTTL = time.Minute
+
+// k8sMetadataCache caches the labels of pods and the zones of nodes. Lookups
+// are best-effort, failures only mean a target is missing some metadata
+type k8sMetadataCache struct {
+	clientset kubernetes.Interface
+	ttl       time.Duration
+
+	l     sync.Mutex
+	pods  map[string]*cachedK8sMetadata
+	nodes map[string]*cachedK8sMetadata
+}
+
+type cachedK8sMetadata struct {
+	labels  map[string]string
+	expires time.Time
+}
+
+func newK8sMetadataCache(clientset kubernetes.Interface) *k8sMetadataCache {
+	return &k8sMetadataCache{
+		clientset: clientset,
+		ttl:       k8sMetadataTTL,
+		pods:      make(map[string]*cachedK8sMetadata),
+		nodes:     make(map[string]*cachedK8sMetadata),
 	}
+}
+
+// podLabels returns the labels of pod `name` in `namespace`
+func (c *k8sMetadataCache) podLabels(ctx context.Context, namespace, name string) map[string]string {
+	return c.get(c.pods, namespace+"/"+name, func() (map[string]string, error) {
+		pod, err := c.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return pod.Labels, nil
+	})
+}
 
-	lockedCh := make(chan bool, 1)
-
-	// start the leader election code loop
-	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
-		Lock:            lock,
-		ReleaseOnCancel: true,
-		LeaseDuration:   opts.TTL,
-		// TODO: Make configrable
-		RenewDeadline: 5 * time.Second,
-		RetryPeriod:   2 * time.Second,
-		Callbacks: leaderelection.LeaderCallbacks{
-			OnStartedLeading: func(ctx context.Context) {
-				logrus.Infof("Lock acquired")
-				lockedCh <- true
-			},
-			OnStoppedLeading: func() {
-				logrus.Infof("Lock lost")
-				lockedCh <- false
-			},
-			OnNewLeader: func(identity string) {},
-		},
+// nodeZone returns the zone of node `name` (empty if it isn't known)
+func (c *k8sMetadataCache) nodeZone(ctx context.Context, name string) string {
+	labels := c.get(c.nodes, name, func() (map[string]string, error) {
+		node, err := c.clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return node.Labels, nil
 	})
+	if zone, ok := labels[corev1.LabelTopologyZone]; ok {
+		return zone
+	}
+	return labels[corev1.LabelFailureDomainBetaZone]
+}
+
+// get returns the unexpired labels of `key` in `m`, looking them up with `lookup` otherwise
+func (c *k8sMetadataCache) get(m map[string]*cachedK8sMetadata, key string, lookup func() (map[string]string, error)) map[string]string {
+	c.l.Lock()
+	cached, ok := m[key]
+	c.l.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.labels
+	}
 
-	return lockedCh, nil
+	// Failures are cached too so that we don't look them up on every update
+	labels, err := lookup()
+	if err != nil {
+		logrus.Debugf("Error looking up metadata of %s: %v", key, err)
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	m[key] = &cachedK8sMetadata{labels: labels, expires: time.Now().Add(c.ttl)}
+	return labels
 }
@@ -0,0 +1,48 @@
+package targetsync
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestK8sEndpointsSource_Target(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "ns", Labels: map[string]string{"app": "web"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{corev1.LabelTopologyZone: "us-east-1a"}}},
+	)
+	src := &K8sEndpointsSource{
+		clientset: clientset,
+		name:      "web",
+		namespace: "ns",
+		port:      8080,
+		metadata:  newK8sMetadataCache(clientset),
+	}
+
+	node := "node1"
+	target := src.target(context.TODO(), corev1.EndpointAddress{
+		IP:        "10.0.0.1",
+		NodeName:  &node,
+		TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "web-1"},
+	})
+	if target.Key() != "10.0.0.1:8080" || target.AvailabilityZone != "us-east-1a" || target.Source != "k8s_endpoints/ns/web" {
+		t.Fatalf("Unexpected target: %+v", target)
+	}
+	if target.Labels["app"] != "web" || target.Labels["k8s/pod"] != "web-1" || target.Labels["k8s/node"] != "node1" {
+		t.Fatalf("Unexpected labels: %v", target.Labels)
+	}
+
+	// Missing pods and nodes only mean missing metadata
+	missing := "node2"
+	target = src.target(context.TODO(), corev1.EndpointAddress{
+		IP:        "10.0.0.2",
+		NodeName:  &missing,
+		TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "web-2"},
+	})
+	if target.Key() != "10.0.0.2:8080" || target.AvailabilityZone != "" || target.Labels["k8s/pod"] != "web-2" {
+		t.Fatalf("Unexpected target: %+v", target)
+	}
+}
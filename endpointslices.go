@@ -0,0 +1,214 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// K8sEndpointSliceSource is a `TargetSource` which watches the EndpointSlices of a Service
+type K8sEndpointSliceSource struct {
+	clientset kubernetes.Interface
+	cfg       *K8sEndpointSlicesConfig
+}
+
+// NewK8sEndpointSliceSource returns a new K8sEndpointSliceSource
+func NewK8sEndpointSliceSource(cfg *K8sEndpointSlicesConfig) (*K8sEndpointSliceSource, error) {
+	c, err := newK8sClientset(&cfg.K8sConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &K8sEndpointSliceSource{
+		clientset: c,
+		cfg:       cfg,
+	}, nil
+}
+
+// Subscribe to implement the `TargetSource` interface
+func (s *K8sEndpointSliceSource) Subscribe(ctx context.Context) (chan []*Target, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.clientset, s.cfg.ResyncPeriod,
+		informers.WithNamespace(s.cfg.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = labels.Set{discovery.LabelServiceName: s.cfg.ServiceName}.String()
+		}),
+	)
+	informer := factory.Discovery().V1beta1().EndpointSlices()
+
+	// changeCh is used to coalesce informer events, we only care that
+	// something changed since we re-list from the cache
+	changeCh := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changeCh <- struct{}{}:
+		default:
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	})
+
+	factory.Start(ctx.Done())
+	for typ, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("Error syncing informer cache for %v", typ)
+		}
+	}
+
+	ch := make(chan []*Target, sourceBufferSize)
+
+	go func(ch chan []*Target) {
+		defer close(ch)
+		var lastKeys []string
+		for {
+			slices, err := informer.Lister().EndpointSlices(s.cfg.Namespace).List(labels.Everything())
+			if err != nil {
+				logrus.Errorf("Error listing endpoint slices: %v", err)
+			} else {
+				targets := s.targetsFromSlices(slices)
+				// Only emit if the set of targets actually changed
+				if keys := targetKeys(targets); lastKeys == nil || !stringsEqual(keys, lastKeys) {
+					lastKeys = keys
+					select {
+					case <-ctx.Done():
+						return
+					case ch <- targets:
+					}
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changeCh:
+			}
+		}
+	}(ch)
+
+	return ch, nil
+}
+
+// targetsFromSlices returns the targets from all ready endpoints in `slices`
+func (s *K8sEndpointSliceSource) targetsFromSlices(slices []*discovery.EndpointSlice) []*Target {
+	targets := make([]*Target, 0)
+	seen := make(map[string]struct{})
+	for _, slice := range slices {
+		if slice.AddressType != discovery.AddressTypeIPv4 && slice.AddressType != discovery.AddressTypeIPv6 {
+			continue
+		}
+
+		port, ok := s.slicePort(slice)
+		if !ok {
+			logrus.Debugf("EndpointSlice %s has no matching port, skipping", slice.Name)
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if !endpointReady(endpoint.Conditions) {
+				continue
+			}
+			for _, addr := range endpoint.Addresses {
+				target := s.target(addr, port, endpoint)
+				// An endpoint may show up in multiple slices while they are being updated
+				if _, ok := seen[target.Key()]; ok {
+					continue
+				}
+				seen[target.Key()] = struct{}{}
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// target returns the target for `addr` of `endpoint` including its metadata.
+// The labels are "k8s/node" and "k8s/pod" if they are known
+func (s *K8sEndpointSliceSource) target(addr string, port int, endpoint discovery.Endpoint) *Target {
+	target := &Target{
+		IP:     addr,
+		Port:   port,
+		Labels: make(map[string]string),
+		Source: fmt.Sprintf("k8s_endpoint_slices/%s/%s", s.cfg.Namespace, s.cfg.ServiceName),
+	}
+	if zone, ok := endpoint.Topology[corev1.LabelTopologyZone]; ok {
+		target.AvailabilityZone = zone
+	}
+	if endpoint.NodeName != nil {
+		target.Labels["k8s/node"] = *endpoint.NodeName
+	} else if node, ok := endpoint.Topology[corev1.LabelHostname]; ok {
+		target.Labels["k8s/node"] = node
+	}
+	if ref := endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+		target.Labels["k8s/pod"] = ref.Name
+	}
+	return target
+}
+
+// slicePort returns the port to use for the targets in `slice`
+func (s *K8sEndpointSliceSource) slicePort(slice *discovery.EndpointSlice) (int, bool) {
+	if s.cfg.Port != 0 {
+		return s.cfg.Port, true
+	}
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		if s.cfg.PortName == "" || (port.Name != nil && *port.Name == s.cfg.PortName) {
+			return int(*port.Port), true
+		}
+	}
+	return 0, false
+}
+
+// endpointReady returns whether an endpoint should receive traffic. Terminating
+// endpoints are never ready, unknown conditions are treated as ready
+func endpointReady(c discovery.EndpointConditions) bool {
+	if c.Terminating != nil && *c.Terminating {
+		return false
+	}
+	if c.Ready != nil {
+		return *c.Ready
+	}
+	if c.Serving != nil {
+		return *c.Serving
+	}
+	return true
+}
+
+// targetKeys returns the sorted keys of `targets`
+func targetKeys(targets []*Target) []string {
+	keys := make([]string, len(targets))
+	for i, target := range targets {
+		keys[i] = target.Key()
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Lock to implement the Locker interface
+func (s *K8sEndpointSliceSource) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
+	return k8sLock(ctx, s.clientset, s.cfg.Namespace, opts)
+}
@@ -0,0 +1,110 @@
+package targetsync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func newTestSlice(endpoints ...discovery.Endpoint) *discovery.EndpointSlice {
+	return &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc-abc",
+			Namespace: "ns",
+			Labels:    map[string]string{discovery.LabelServiceName: "svc"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Ports:       []discovery.EndpointPort{{Port: int32Ptr(8080)}},
+		Endpoints:   endpoints,
+	}
+}
+
+func TestK8sEndpointSliceSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slice := newTestSlice(
+		discovery.Endpoint{Addresses: []string{"1"}, Conditions: discovery.EndpointConditions{Ready: boolPtr(true)}},
+		discovery.Endpoint{Addresses: []string{"2"}, Conditions: discovery.EndpointConditions{Ready: boolPtr(false)}},
+		discovery.Endpoint{Addresses: []string{"3"}},
+	)
+	clientset := fake.NewSimpleClientset(slice)
+	src := &K8sEndpointSliceSource{
+		clientset: clientset,
+		cfg: &K8sEndpointSlicesConfig{
+			ServiceName: "svc",
+			Namespace:   "ns",
+		},
+	}
+
+	ch, err := src.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+
+	expected := []*Target{{IP: "1", Port: 8080}, {IP: "3", Port: 8080}}
+	tgts := <-ch
+	if err := equalTargets(expected, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, tgts)
+	}
+
+	// Mark one of the endpoints as terminating, it should be removed even though it is still serving
+	slice = newTestSlice(
+		discovery.Endpoint{Addresses: []string{"1"}, Conditions: discovery.EndpointConditions{Ready: boolPtr(true)}},
+		discovery.Endpoint{Addresses: []string{"2"}, Conditions: discovery.EndpointConditions{Ready: boolPtr(false)}},
+		discovery.Endpoint{Addresses: []string{"3"}, Conditions: discovery.EndpointConditions{Serving: boolPtr(true), Terminating: boolPtr(true)}},
+	)
+	if _, err := clientset.DiscoveryV1beta1().EndpointSlices("ns").Update(ctx, slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Error updating slice: %v", err)
+	}
+
+	expected = []*Target{{IP: "1", Port: 8080}}
+	select {
+	case tgts = <-ch:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for targets")
+	}
+	if err := equalTargets(expected, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, tgts)
+	}
+
+	// An update which doesn't change the targets shouldn't emit anything
+	slice.Labels["foo"] = "bar"
+	if _, err := clientset.DiscoveryV1beta1().EndpointSlices("ns").Update(ctx, slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Error updating slice: %v", err)
+	}
+	select {
+	case tgts = <-ch:
+		t.Fatalf("Unexpected targets from source: %+v", tgts)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestK8sEndpointSliceSource_Metadata(t *testing.T) {
+	src := &K8sEndpointSliceSource{cfg: &K8sEndpointSlicesConfig{ServiceName: "svc", Namespace: "ns"}}
+	node := "node1"
+	slice := newTestSlice(discovery.Endpoint{
+		Addresses: []string{"1"},
+		Topology:  map[string]string{corev1.LabelTopologyZone: "us-east-1a"},
+		NodeName:  &node,
+		TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "svc-1"},
+	})
+
+	targets := src.targetsFromSlices([]*discovery.EndpointSlice{slice})
+	if len(targets) != 1 {
+		t.Fatalf("Expected 1 target, got %+v", targets)
+	}
+	target := targets[0]
+	if target.AvailabilityZone != "us-east-1a" || target.Source != "k8s_endpoint_slices/ns/svc" || target.Labels["k8s/node"] != "node1" || target.Labels["k8s/pod"] != "svc-1" {
+		t.Fatalf("Unexpected target: %+v", target)
+	}
+}
@@ -0,0 +1,286 @@
+package targetsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// defaultEtcdDialTimeout is how long to wait to connect to etcd if not configured
+	defaultEtcdDialTimeout = 5 * time.Second
+	// etcdRetryDelay is how long to wait before retrying a failed get/watch
+	etcdRetryDelay = time.Second
+)
+
+// newEtcdClient creates an etcd client from `cfg`
+func newEtcdClient(cfg *EtcdClientConfig) (*clientv3.Client, error) {
+	clientCfg := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		DialTimeout: cfg.DialTimeout,
+	}
+	if clientCfg.DialTimeout == 0 {
+		clientCfg.DialTimeout = defaultEtcdDialTimeout
+	}
+	if cfg.TLS.isSet() {
+		tlsInfo := transport.TLSInfo{
+			ServerName:         cfg.TLS.ServerName,
+			TrustedCAFile:      cfg.TLS.CAFile,
+			CertFile:           cfg.TLS.CertFile,
+			KeyFile:            cfg.TLS.KeyFile,
+			InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+		}
+		tlsCfg, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("Error loading etcd TLS config: %v", err)
+		}
+		clientCfg.TLS = tlsCfg
+	}
+	return clientv3.New(clientCfg)
+}
+
+// EtcdSource is a `TargetSource` (and `Locker`) watching the service instances
+// registered under a key prefix in etcd. Each value is either a JSON encoded
+// `Target` or "ip:port"
+type EtcdSource struct {
+	cfg    *EtcdConfig
+	client *clientv3.Client
+}
+
+// NewEtcdSource returns a new EtcdSource
+func NewEtcdSource(cfg *EtcdConfig) (*EtcdSource, error) {
+	client, err := newEtcdClient(&cfg.ClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdSource{cfg: cfg, client: client}, nil
+}
+
+// Close closes the etcd client, to implement `io.Closer`
+func (s *EtcdSource) Close() error {
+	return s.client.Close()
+}
+
+// Lock to implement the Locker interface
+func (s *EtcdSource) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
+	return (&EtcdLocker{client: s.client}).Lock(ctx, opts)
+}
+
+// Subscribe to implement the `TargetSource` interface
+func (s *EtcdSource) Subscribe(ctx context.Context) (chan []*Target, error) {
+	ch := make(chan []*Target, sourceBufferSize)
+
+	go func(ch chan []*Target) {
+		defer close(ch)
+		for {
+			err := s.watch(ctx, ch)
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Errorf("Error watching etcd prefix %s, restarting watch: %v", s.cfg.Prefix, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(etcdRetryDelay):
+			}
+		}
+	}(ch)
+
+	return ch, nil
+}
+
+// watch sends the targets under the prefix to `ch` and then again each time
+// they change, until the watch fails
+func (s *EtcdSource) watch(ctx context.Context, ch chan []*Target) error {
+	resp, err := s.client.Get(ctx, s.cfg.Prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	values := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		values[string(kv.Key)] = kv.Value
+	}
+	if !s.send(ctx, ch, values) {
+		return nil
+	}
+
+	// Watch from just after the snapshot so that no changes are missed
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchCh := s.client.Watch(clientv3.WithRequireLeader(watchCtx), s.cfg.Prefix,
+		clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+	for watchResp := range watchCh {
+		if err := watchResp.Err(); err != nil {
+			return err
+		}
+		for _, event := range watchResp.Events {
+			switch event.Type {
+			case clientv3.EventTypePut:
+				values[string(event.Kv.Key)] = event.Kv.Value
+			case clientv3.EventTypeDelete:
+				delete(values, string(event.Kv.Key))
+			}
+		}
+		if !s.send(ctx, ch, values) {
+			return nil
+		}
+	}
+	return fmt.Errorf("watch closed")
+}
+
+// send sends the targets for `values` to `ch`, returning false if `ctx` is done
+func (s *EtcdSource) send(ctx context.Context, ch chan []*Target, values map[string][]byte) bool {
+	targets := make([]*Target, 0, len(values))
+	seen := make(map[string]struct{}, len(values))
+	for key, value := range values {
+		target, err := s.target(key, value)
+		if err != nil {
+			logrus.Warnf("Skipping invalid etcd service instance %s: %v", key, err)
+			continue
+		}
+		if _, ok := seen[target.Key()]; ok {
+			continue
+		}
+		seen[target.Key()] = struct{}{}
+		targets = append(targets, target)
+	}
+	sortTargets(targets)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case ch <- targets:
+		return true
+	}
+}
+
+// target decodes the service instance `value` registered at `key`
+func (s *EtcdSource) target(key string, value []byte) (*Target, error) {
+	target := &Target{}
+	if trimmed := strings.TrimSpace(string(value)); strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal([]byte(trimmed), target); err != nil {
+			return nil, fmt.Errorf("Error decoding JSON: %v", err)
+		}
+	} else {
+		host, port, err := net.SplitHostPort(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		target.IP = host
+		if target.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	if net.ParseIP(target.IP) == nil {
+		return nil, fmt.Errorf("invalid ip %q", target.IP)
+	}
+	if target.Port < 1 || target.Port > 65535 {
+		return nil, fmt.Errorf("port %d must be between 1 and 65535", target.Port)
+	}
+	if target.Labels == nil {
+		target.Labels = make(map[string]string)
+	}
+	target.Labels["etcd/key"] = key
+	target.Source = fmt.Sprintf("etcd/%s", s.cfg.Prefix)
+	return target, nil
+}
+
+// EtcdLocker is a `Locker` using an etcd mutex (independent of the source).
+// The mutex is held by a session with a lease of the lock TTL, so the lock is
+// lost if we can't keep the lease alive
+type EtcdLocker struct {
+	client *clientv3.Client
+}
+
+// NewEtcdLocker returns a new EtcdLocker
+func NewEtcdLocker(cfg *EtcdClientConfig) (*EtcdLocker, error) {
+	client, err := newEtcdClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdLocker{client: client}, nil
+}
+
+// Close closes the etcd client, to implement `io.Closer`
+func (l *EtcdLocker) Close() error {
+	return l.client.Close()
+}
+
+// Lock to implement the Locker interface. The lock is released and the
+// channel closed once `ctx` is done
+func (l *EtcdLocker) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
+	ttl := int(opts.TTL.Seconds())
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	lockedCh := make(chan bool, 1)
+	go func() {
+		defer close(lockedCh)
+		for {
+			err := l.lockOnce(ctx, opts.Key, ttl, lockedCh)
+			if err != nil {
+				logrus.Errorf("Error acquiring lock: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(etcdRetryDelay):
+			}
+		}
+	}()
+	return lockedCh, nil
+}
+
+// lockOnce acquires the lock with a new session, holding it until either the
+// session expires or `ctx` is done
+func (l *EtcdLocker) lockOnce(ctx context.Context, key string, ttl int, lockedCh chan bool) error {
+	session, err := concurrency.NewSession(l.client, concurrency.WithTTL(ttl))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	mutex := concurrency.NewMutex(session, key)
+	if err := mutex.Lock(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	logrus.Infof("Lock acquired")
+	select {
+	case <-ctx.Done():
+	case lockedCh <- true:
+	}
+
+	select {
+	case <-ctx.Done():
+		logrus.Infof("Context done, releasing lock")
+		unlockCtx, cancel := context.WithTimeout(context.Background(), etcdRetryDelay)
+		defer cancel()
+		if err := mutex.Unlock(unlockCtx); err != nil {
+			logrus.Errorf("Error releasing lock: %v", err)
+		}
+	case <-session.Done():
+		logrus.Infof("Lock lost")
+		select {
+		case <-ctx.Done():
+		case lockedCh <- false:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+)
+
+// newTestEtcd returns a client for the etcd cluster at the (comma separated)
+// endpoints in $TARGETSYNC_TEST_ETCD_ENDPOINTS, skipping the test if it isn't
+// set. The client is namespaced to a prefix for the test which is deleted after
+func newTestEtcd(t *testing.T) *clientv3.Client {
+	endpoints := os.Getenv("TARGETSYNC_TEST_ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("TARGETSYNC_TEST_ETCD_ENDPOINTS isn't set")
+	}
+
+	client, err := newEtcdClient(&EtcdClientConfig{Endpoints: strings.Split(endpoints, ",")})
+	if err != nil {
+		t.Fatalf("Error creating etcd client: %v", err)
+	}
+	prefix := fmt.Sprintf("/targetsync-test/%s/%d", t.Name(), time.Now().UnixNano())
+	kv := client.KV
+	t.Cleanup(func() {
+		// The client is closed by some tests
+		if client.Ctx().Err() != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := kv.Delete(ctx, prefix, clientv3.WithPrefix()); err != nil {
+			t.Errorf("Error cleaning up %s: %v", prefix, err)
+		}
+		client.Close()
+	})
+
+	client.KV = namespace.NewKV(client.KV, prefix)
+	client.Watcher = namespace.NewWatcher(client.Watcher, prefix)
+	client.Lease = namespace.NewLease(client.Lease, prefix)
+	return client
+}
+
+// nextTargets returns the next targets from `ch`, failing the test on a timeout
+func nextTargets(t *testing.T, ch chan []*Target) []*Target {
+	select {
+	case targets := <-ch:
+		return targets
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for targets")
+	}
+	return nil
+}
+
+func TestEtcdSource(t *testing.T) {
+	client := newTestEtcd(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	values := map[string]string{
+		"/services/web/a":   "10.0.0.1:80",
+		"/services/web/b":   `{"ip": "10.0.0.2", "port": 80, "availability_zone": "us-east-1a", "labels": {"version": "2"}}`,
+		"/services/web/bad": "not-a-target",
+		"/services/other/c": "10.0.0.3:80",
+	}
+	for k, v := range values {
+		if _, err := client.Put(ctx, k, v); err != nil {
+			t.Fatalf("Error putting %s: %v", k, err)
+		}
+	}
+
+	src := &EtcdSource{cfg: &EtcdConfig{Prefix: "/services/web/"}, client: client}
+	ch, err := src.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+
+	expected := []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "10.0.0.2", Port: 80}}
+	targets := nextTargets(t, ch)
+	if err := equalTargets(expected, targets); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, targets)
+	}
+	if b := targets[1]; b.AvailabilityZone != "us-east-1a" || b.Labels["version"] != "2" || b.Labels["etcd/key"] != "/services/web/b" || b.Source != "etcd//services/web/" {
+		t.Fatalf("Unexpected metadata: %+v", b)
+	}
+
+	// Changes are picked up by the watch
+	if _, err := client.Delete(ctx, "/services/web/a"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	expected = []*Target{{IP: "10.0.0.2", Port: 80}}
+	if targets = nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+	if _, err := client.Put(ctx, "/services/web/d", "[fd00::1]:8080"); err != nil {
+		t.Fatalf("Error putting: %v", err)
+	}
+	expected = []*Target{{IP: "10.0.0.2", Port: 80}, {IP: "fd00::1", Port: 8080}}
+	if targets = nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+}
+
+func TestEtcdSource_Close(t *testing.T) {
+	client := newTestEtcd(t)
+	src := &EtcdSource{cfg: &EtcdConfig{Prefix: "/"}, client: client}
+	if err := src.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	// The client can no longer be used
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := client.Get(ctx, "/"); err == nil {
+		t.Fatalf("Expected error using a closed client")
+	}
+}
+
+func TestEtcdSource_target(t *testing.T) {
+	src := &EtcdSource{cfg: &EtcdConfig{Prefix: "/"}}
+	tests := map[string]error{
+		"10.0.0.1:80": nil,
+		" {\"ip\": \"10.0.0.1\", \"port\": 80}\n": nil,
+		"10.0.0.1":           fmt.Errorf("missing port"),
+		"10.0.0.1:0":         fmt.Errorf("bad port"),
+		"host:80":            fmt.Errorf("not an ip"),
+		`{"ip": "10.0.0.1"}`: fmt.Errorf("missing port"),
+		`{"ip": 1}`:          fmt.Errorf("bad json"),
+	}
+	for value, expected := range tests {
+		if _, err := src.target("/key", []byte(value)); (err == nil) != (expected == nil) {
+			t.Fatalf("Unexpected result for %q: %v", value, err)
+		}
+	}
+}
+
+func TestEtcdLocker(t *testing.T) {
+	client := newTestEtcd(t)
+	locker := &EtcdLocker{client: client}
+	opts := &LockOptions{Key: "/locks/targetsync", TTL: 5 * time.Second}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	chA, err := locker.Lock(ctxA, opts)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	select {
+	case locked := <-chA:
+		if !locked {
+			t.Fatalf("Expected lock to be acquired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for lock")
+	}
+
+	// The lock is held so the second locker has to wait
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	chB, err := locker.Lock(ctxB, opts)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	select {
+	case locked := <-chB:
+		t.Fatalf("Unexpected lock update while the lock is held: %v", locked)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Once released the lock is picked up by the second locker
+	cancelA()
+	select {
+	case locked := <-chB:
+		if !locked {
+			t.Fatalf("Expected lock to be acquired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for lock")
+	}
+
+	// The channel is closed once the context is done
+	cancelB()
+	for range chB {
+	}
+}
@@ -0,0 +1,271 @@
+package targetsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// File formats which can be set in FileConfig
+const (
+	// FileFormatYAML is a list of targets (JSON is also accepted)
+	FileFormatYAML = "yaml"
+	// FileFormatJSON is a list of targets
+	FileFormatJSON = "json"
+	// FileFormatText is a target per line as "ip:port" (or "ip" using the
+	// configured port), blank lines and lines starting with "#" are ignored
+	FileFormatText = "text"
+)
+
+// fileTarget is a target as written in a YAML/JSON file
+type fileTarget struct {
+	IP               string            `yaml:"ip" json:"ip"`
+	Port             int               `yaml:"port" json:"port"`
+	AvailabilityZone string            `yaml:"availability_zone" json:"availability_zone"`
+	Weight           int               `yaml:"weight" json:"weight"`
+	Labels           map[string]string `yaml:"labels" json:"labels"`
+}
+
+// hupNotifier forwards SIGHUP to the running file sources. The handler is
+// registered once for the life of the process, so SIGHUP never falls back to
+// its default action (terminating the process) while no source is subscribed
+type hupNotifier struct {
+	once sync.Once
+	l    sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+var hup = &hupNotifier{subs: make(map[chan struct{}]struct{})}
+
+// start registers the SIGHUP handler if it isn't already
+func (h *hupNotifier) start() {
+	h.once.Do(func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGHUP)
+		go func() {
+			for range sigCh {
+				h.l.Lock()
+				for sub := range h.subs {
+					select {
+					case sub <- struct{}{}:
+					default:
+					}
+				}
+				h.l.Unlock()
+			}
+		}()
+	})
+}
+
+// subscribe returns a channel notified on each SIGHUP until unsubscribed
+func (h *hupNotifier) subscribe() chan struct{} {
+	h.start()
+	ch := make(chan struct{}, 1)
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *hupNotifier) unsubscribe(ch chan struct{}) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	delete(h.subs, ch)
+}
+
+// FileSource is a `TargetSource` reading targets from a file. The file is
+// re-read whenever it changes and on SIGHUP
+type FileSource struct {
+	cfg *FileConfig
+}
+
+// NewFileSource returns a new FileSource
+func NewFileSource(cfg *FileConfig) (*FileSource, error) {
+	hup.start()
+	return &FileSource{cfg: cfg}, nil
+}
+
+// Subscribe to implement the `TargetSource` interface. An error is returned
+// if the file can't be loaded initially, later errors are logged and the last
+// good targets are kept
+func (s *FileSource) Subscribe(ctx context.Context) (chan []*Target, error) {
+	targets, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Watch the directory rather than the file so that replacing the file
+	// (e.g. atomic renames or kubernetes ConfigMap updates) is picked up
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file watcher: %v", err)
+	}
+	if err := watcher.Add(filepath.Dir(s.cfg.Path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("Error watching %s: %v", s.cfg.Path, err)
+	}
+	hupCh := hup.subscribe()
+
+	ch := make(chan []*Target, sourceBufferSize)
+	ch <- targets
+
+	go func(ch chan []*Target) {
+		defer close(ch)
+		defer watcher.Close()
+		defer hup.unsubscribe(hupCh)
+		for {
+			force := false
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupCh:
+				logrus.Infof("Received SIGHUP, reloading %s", s.cfg.Path)
+				force = true
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				logrus.Debugf("File event %v", event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Errorf("Error watching %s: %v", s.cfg.Path, err)
+				continue
+			}
+
+			loaded, err := s.load()
+			if err != nil {
+				logrus.Errorf("Error reloading %s, keeping the previous targets: %v", s.cfg.Path, err)
+				continue
+			}
+			// Only emit if the targets actually changed (or were explicitly reloaded)
+			if !force && reflect.DeepEqual(loaded, targets) {
+				continue
+			}
+			targets = loaded
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- targets:
+			}
+		}
+	}(ch)
+
+	return ch, nil
+}
+
+// format returns the format of the file, from its extension if not configured
+func (s *FileSource) format() string {
+	if s.cfg.Format != "" {
+		return s.cfg.Format
+	}
+	switch strings.ToLower(filepath.Ext(s.cfg.Path)) {
+	case ".yaml", ".yml":
+		return FileFormatYAML
+	case ".json":
+		return FileFormatJSON
+	default:
+		return FileFormatText
+	}
+}
+
+// load reads and validates the targets in the file
+func (s *FileSource) load() ([]*Target, error) {
+	b, err := ioutil.ReadFile(s.cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading targets: %v", err)
+	}
+
+	var entries []*fileTarget
+	switch s.format() {
+	case FileFormatYAML:
+		err = yaml.UnmarshalStrict(b, &entries)
+	case FileFormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&entries)
+	default:
+		entries, err = s.parseText(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing targets: %v", err)
+	}
+
+	var errs ValidationErrors
+	targets := make([]*Target, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+	for i, entry := range entries {
+		if entry == nil {
+			errs.addf("target %d is empty", i)
+			continue
+		}
+		target := &Target{
+			IP:               entry.IP,
+			Port:             entry.Port,
+			AvailabilityZone: entry.AvailabilityZone,
+			Weight:           entry.Weight,
+			Labels:           entry.Labels,
+			Source:           fmt.Sprintf("file/%s", s.cfg.Path),
+		}
+		if target.Port == 0 {
+			target.Port = s.cfg.Port
+		}
+		if net.ParseIP(target.IP) == nil {
+			errs.addf("target %d: invalid ip %q", i, target.IP)
+			continue
+		}
+		if target.Port < 1 || target.Port > 65535 {
+			errs.addf("target %d: port %d must be between 1 and 65535", i, target.Port)
+			continue
+		}
+		if _, ok := seen[target.Key()]; ok {
+			errs.addf("target %d: duplicate target %s", i, target.Key())
+			continue
+		}
+		seen[target.Key()] = struct{}{}
+		targets = append(targets, target)
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	sortTargets(targets)
+	return targets, nil
+}
+
+// parseText parses a target per line as "ip:port" or "ip"
+func (s *FileSource) parseText(b []byte) ([]*fileTarget, error) {
+	entries := make([]*fileTarget, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		entry := &fileTarget{IP: text}
+		if host, port, err := net.SplitHostPort(text); err == nil {
+			entry.IP = host
+			if entry.Port, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("line %d: invalid port %q", line, port)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,165 @@
+package targetsync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileSource_load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "targetsync")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		expected []*Target
+		err      bool
+	}{
+		{
+			name:     "yaml",
+			file:     "targets.yaml",
+			content:  "- ip: 10.0.0.1\n  port: 80\n  availability_zone: us-east-1a\n  labels:\n    rack: r1\n- ip: 10.0.0.2\n",
+			expected: []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "10.0.0.2", Port: 8080}},
+		},
+		{
+			name:     "json",
+			file:     "targets.json",
+			content:  `[{"ip": "10.0.0.1", "port": 80}, {"ip": "fd00::1", "weight": 2}]`,
+			expected: []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "fd00::1", Port: 8080}},
+		},
+		{
+			name:     "text",
+			file:     "targets",
+			content:  "# comment\n10.0.0.1:80\n\n  10.0.0.2\n[fd00::1]:81\n",
+			expected: []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "10.0.0.2", Port: 8080}, {IP: "fd00::1", Port: 81}},
+		},
+		{name: "empty", file: "empty.yaml", expected: []*Target{}},
+		{name: "bad ip", file: "bad.txt", content: "10.0.0.1:80\nhost:80\n", err: true},
+		{name: "bad port", file: "bad.json", content: `[{"ip": "10.0.0.1", "port": 70000}]`, err: true},
+		{name: "duplicate", file: "dup.txt", content: "10.0.0.1:8080\n10.0.0.1\n", err: true},
+		{name: "unknown field", file: "unknown.yaml", content: "- ip: 10.0.0.1\n  prot: 80\n", err: true},
+		{name: "missing", file: "missing.yaml", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.file)
+			if test.name != "missing" {
+				if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+					t.Fatalf("Error writing file: %v", err)
+				}
+			}
+			src := &FileSource{cfg: &FileConfig{Path: path, Port: 8080}}
+			targets, err := src.load()
+			if test.err != (err != nil) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := equalTargets(test.expected, targets); err != nil {
+				t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, test.expected, targets)
+			}
+		})
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "targetsync")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "targets")
+	write := func(content string) {
+		// Replace the file atomically as most tools do
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("Error renaming file: %v", err)
+		}
+	}
+	write("10.0.0.1:80\n")
+
+	src := &FileSource{cfg: &FileConfig{Path: path}}
+	ch, err := src.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	expected := []*Target{{IP: "10.0.0.1", Port: 80}}
+	if targets := nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+
+	// Changes to the file are picked up
+	write("10.0.0.1:80\n10.0.0.2:80\n")
+	expected = []*Target{{IP: "10.0.0.1", Port: 80}, {IP: "10.0.0.2", Port: 80}}
+	if targets := nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+
+	// An invalid file is ignored, keeping the previous targets
+	write("10.0.0.1:80\nnot-an-ip\n")
+	select {
+	case targets := <-ch:
+		t.Fatalf("Unexpected targets from invalid file: %+v", targets)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// SIGHUP reloads the file even if nothing changed
+	if runtime.GOOS == "windows" {
+		return
+	}
+	write("10.0.0.2:80\n")
+	expected = []*Target{{IP: "10.0.0.2", Port: 80}}
+	if targets := nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Error finding process: %v", err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Error sending SIGHUP: %v", err)
+	}
+	if targets := nextTargets(t, ch); equalTargets(expected, targets) != nil {
+		t.Fatalf("Mismatch in targets expected=%+v actual=%+v", expected, targets)
+	}
+
+	// The source can't be subscribed to if the file is invalid
+	write("not-an-ip\n")
+	if _, err := (&FileSource{cfg: &FileConfig{Path: path}}).Subscribe(ctx); err == nil {
+		t.Fatalf("Expected error subscribing to an invalid file")
+	}
+}
+
+func TestFileSource_sighupWithoutSubscription(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGHUP isn't supported on windows")
+	}
+	if _, err := NewFileSource(&FileConfig{Path: "/etc/targetsync/targets"}); err != nil {
+		t.Fatalf("Error creating source: %v", err)
+	}
+
+	// Without a handler SIGHUP would terminate the test process
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Error finding process: %v", err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Error sending SIGHUP: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+}
@@ -0,0 +1,16 @@
+package targetsync
+
+import (
+	"fmt"
+	"os"
+)
+
+// tryLockFile isn't supported on windows
+func tryLockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("file locks aren't supported on windows")
+}
+
+// unlockFile isn't supported on windows
+func unlockFile(f *os.File) error {
+	return nil
+}
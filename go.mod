@@ -5,29 +5,28 @@ go 1.15
 require (
 	github.com/armon/go-metrics v0.3.4 // indirect
 	github.com/aws/aws-sdk-go v1.23.13
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-ini/ini v1.38.2 // indirect
-	github.com/googleapis/gnostic v0.3.0 // indirect
-	github.com/hashicorp/consul v1.2.3
+	github.com/hashicorp/consul/api v1.4.0
 	github.com/hashicorp/go-msgpack v1.1.5 // indirect
-	github.com/hashicorp/go-rootcerts v0.0.0-20160503143440-6bb64b370b90 // indirect
 	github.com/hashicorp/go-uuid v1.0.2 // indirect
 	github.com/hashicorp/memberlist v0.2.2 // indirect
-	github.com/hashicorp/serf v0.8.1 // indirect
 	github.com/imdario/mergo v0.3.7 // indirect
 	github.com/jacksontj/lane v1.0.1-0.20200915204505-94dc08d5ca31
 	github.com/jessevdk/go-flags v1.4.0
-	github.com/mitchellh/go-homedir v1.0.0 // indirect
+	github.com/miekg/dns v1.1.26
 	github.com/mitchellh/go-testing-interface v1.14.1 // indirect
-	github.com/mitchellh/mapstructure v1.0.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/sirupsen/logrus v1.4.2
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/sirupsen/logrus v1.7.0
 	github.com/smartystreets/goconvey v1.6.4 // indirect
-	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
-	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
-	google.golang.org/appengine v1.6.1 // indirect
+	go.etcd.io/etcd/client/pkg/v3 v3.5.0
+	go.etcd.io/etcd/client/v3 v3.5.0
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/ini.v1 v1.61.0 // indirect
-	gopkg.in/yaml.v2 v2.2.5
-	k8s.io/apimachinery v0.17.0
-	k8s.io/client-go v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
+	k8s.io/api v0.20.15
+	k8s.io/apimachinery v0.20.15
+	k8s.io/client-go v0.20.15
 )
@@ -2,14 +2,26 @@ package targetsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 )
 
-// Target represents a single IP+Port pair
+// Target represents a single IP+Port pair along with optional metadata from
+// the source. Only the IP+Port identify the target, the metadata is only used
+// by destinations which support it
 type Target struct {
-	IP   string
-	Port int
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+
+	// AvailabilityZone is the zone the target is running in
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	// Weight is the relative amount of traffic the target should receive (0 if unset)
+	Weight int `json:"weight,omitempty"`
+	// Labels are arbitrary metadata (e.g. consul tags/meta, kubernetes pod labels)
+	Labels map[string]string `json:"labels,omitempty"`
+	// Source is the name of the source the target came from
+	Source string `json:"source,omitempty"`
 }
 
 // Key returns a unique key identifying this specific target
@@ -17,6 +29,30 @@ func (t *Target) Key() string {
 	return fmt.Sprintf("%s:%d", t.IP, t.Port)
 }
 
+// withPort returns a copy of the target (including its metadata) on `port`
+func (t *Target) withPort(port int) *Target {
+	c := *t
+	c.Port = port
+	return &c
+}
+
+// withZone returns a copy of the target (including its metadata) in `zone`
+func (t *Target) withZone(zone string) *Target {
+	c := *t
+	c.AvailabilityZone = zone
+	return &c
+}
+
+// withIP returns a copy of the target (including its metadata) with `ip`
+func (t *Target) withIP(ip string) *Target {
+	c := *t
+	c.IP = ip
+	return &c
+}
+
+// sourceBufferSize is the size of the channel each source sends targets on
+const sourceBufferSize = 100
+
 // TargetSource is an interface for getting targets for a given config
 // TODO: plugin etc.
 type TargetSource interface {
@@ -33,6 +69,46 @@ type TargetDestination interface {
 	RemoveTargets(context.Context, []*Target) error
 }
 
+// Errors which a TargetDestination can return (wrapped) for the Syncer to act on
+var (
+	// ErrDestinationNotFound means the destination doesn't exist, so retrying won't help
+	ErrDestinationNotFound = errors.New("destination not found")
+	// ErrTooManyTargets means the destination can't hold any more targets
+	ErrTooManyTargets = errors.New("too many targets")
+	// ErrInvalidTarget means one or more of the targets can't be registered
+	ErrInvalidTarget = errors.New("invalid target")
+	// ErrThrottled means the request was rate limited
+	ErrThrottled = errors.New("request throttled")
+	// ErrHealthUnavailable means the health of the targets couldn't be fetched
+	ErrHealthUnavailable = errors.New("target health unavailable")
+)
+
+// TargetMapper may be implemented by a TargetDestination which registers targets
+// differently than they are in the source (e.g. on another port)
+type TargetMapper interface {
+	// MapTargets returns the targets to register for `targets` from the source
+	MapTargets([]*Target) []*Target
+}
+
+// TargetHealth is the health of a target at the destination
+type TargetHealth struct {
+	Target *Target `json:"target"`
+	// Healthy is whether the destination is sending traffic to the target
+	Healthy bool `json:"healthy"`
+	// State is the destination specific state of the target (e.g. "draining")
+	State string `json:"state"`
+	// Reason and Description explain the state (if the destination provides them)
+	Reason      string `json:"reason,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// TargetHealthChecker may be implemented by a TargetDestination which checks
+// the health of its targets
+type TargetHealthChecker interface {
+	// GetTargetHealth returns the health of each target at the destination
+	GetTargetHealth(context.Context) ([]*TargetHealth, error)
+}
+
 // LockOptions holds the options for locking/leader-election
 type LockOptions struct {
 	Key string        `yaml:"key"`
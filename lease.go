@@ -0,0 +1,174 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// defaultRenewDeadline is how long the leader retries renewing the lease for
+	defaultRenewDeadline = 5 * time.Second
+	// defaultRetryPeriod is how often to retry acquiring or renewing the lease
+	defaultRetryPeriod = 2 * time.Second
+	// podNameEnv is the environment variable holding the name of our pod
+	podNameEnv = "POD_NAME"
+)
+
+// timings returns the renew deadline and retry period, defaulting any not configured
+func (c *K8sLeaseConfig) timings() (renewDeadline, retryPeriod time.Duration) {
+	renewDeadline, retryPeriod = c.RenewDeadline, c.RetryPeriod
+	if renewDeadline == 0 {
+		renewDeadline = defaultRenewDeadline
+	}
+	if retryPeriod == 0 {
+		retryPeriod = defaultRetryPeriod
+	}
+	return renewDeadline, retryPeriod
+}
+
+// validateTimings checks the rules leaderelection enforces on the (defaulted)
+// timings for a lease of `leaseDuration`
+func (c *K8sLeaseConfig) validateTimings(leaseDuration time.Duration) error {
+	var errs ValidationErrors
+	renewDeadline, retryPeriod := c.timings()
+	if leaseDuration <= renewDeadline {
+		errs.addf("lock_options ttl %v must be greater than renew_deadline %v", leaseDuration, renewDeadline)
+	}
+	if float64(renewDeadline) <= leaderelection.JitterFactor*float64(retryPeriod) {
+		errs.addf("renew_deadline %v must be greater than %v x retry_period %v", renewDeadline, leaderelection.JitterFactor, retryPeriod)
+	}
+	return errs.err()
+}
+
+// K8sLeaseLocker is a `Locker` which does leader-election using a
+// coordination.k8s.io Lease named after the lock key
+type K8sLeaseLocker struct {
+	clientset kubernetes.Interface
+	cfg       *K8sLeaseConfig
+	// lockType is the resourcelock type to use, sources use a ConfigMap+Lease
+	// multilock so that they are compatible with the ConfigMap lock they used to take
+	lockType string
+}
+
+// NewK8sLeaseLocker returns a new K8sLeaseLocker
+func NewK8sLeaseLocker(cfg *K8sLeaseConfig) (*K8sLeaseLocker, error) {
+	c, err := newK8sClientset(&cfg.K8sConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &K8sLeaseLocker{
+		clientset: c,
+		cfg:       cfg,
+		lockType:  resourcelock.LeasesResourceLock,
+	}, nil
+}
+
+// identity returns the identity to hold the lease as
+func (l *K8sLeaseLocker) identity() (string, error) {
+	if l.cfg.Identity != "" {
+		return l.cfg.Identity, nil
+	}
+	if name := os.Getenv(podNameEnv); name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// Lock to implement the Locker interface. Leader-election runs in the
+// background until `ctx` is done, at which point the lease is released and
+// the channel closed
+func (l *K8sLeaseLocker) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
+	identity, err := l.identity()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting lock identity: %v", err)
+	}
+	lock, err := resourcelock.New(l.lockType, l.cfg.Namespace, opts.Key,
+		l.clientset.CoreV1(), l.clientset.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating lock: %v", err)
+	}
+
+	lockedCh := make(chan bool, 1)
+	// mu guards leading so that a late OnStartedLeading can't follow OnStoppedLeading
+	var mu sync.Mutex
+	leading := false
+	send := func(locked bool) {
+		select {
+		case <-ctx.Done():
+		case lockedCh <- locked:
+		}
+	}
+
+	renewDeadline, retryPeriod := l.cfg.timings()
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   opts.TTL,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		Name:            opts.Key,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				mu.Lock()
+				defer mu.Unlock()
+				if leaderCtx.Err() != nil {
+					return
+				}
+				logrus.Infof("Lock acquired")
+				leading = true
+				send(true)
+			},
+			OnStoppedLeading: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if !leading {
+					return
+				}
+				logrus.Infof("Lock lost")
+				leading = false
+				send(false)
+			},
+			OnNewLeader: func(leader string) {
+				logrus.Debugf("Lock %s held by %s", opts.Key, leader)
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating leader elector: %v", err)
+	}
+
+	go func() {
+		defer close(lockedCh)
+		// Run returns once the lease is lost, so keep trying to re-acquire it
+		for {
+			elector.Run(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryPeriod):
+			}
+		}
+	}()
+
+	return lockedCh, nil
+}
+
+// k8sLock does leader-election in `namespace` for the k8s sources
+func k8sLock(ctx context.Context, clientset kubernetes.Interface, namespace string, opts *LockOptions) (<-chan bool, error) {
+	l := &K8sLeaseLocker{
+		clientset: clientset,
+		cfg:       &K8sLeaseConfig{Namespace: namespace},
+		lockType:  resourcelock.ConfigMapsLeasesResourceLock,
+	}
+	return l.Lock(ctx, opts)
+}
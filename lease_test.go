@@ -0,0 +1,83 @@
+package targetsync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func TestK8sLeaseLocker(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	newLocker := func(identity string) *K8sLeaseLocker {
+		return &K8sLeaseLocker{
+			clientset: clientset,
+			cfg: &K8sLeaseConfig{
+				Namespace:     "ns",
+				Identity:      identity,
+				RenewDeadline: time.Second,
+				RetryPeriod:   100 * time.Millisecond,
+			},
+			lockType: resourcelock.LeasesResourceLock,
+		}
+	}
+	opts := &LockOptions{Key: "targetsync", TTL: 2 * time.Second}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	chA, err := newLocker("a").Lock(ctxA, opts)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	select {
+	case locked := <-chA:
+		if !locked {
+			t.Fatalf("Expected lock to be acquired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for lock")
+	}
+
+	// The lease is held so the second locker has to wait
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	chB, err := newLocker("b").Lock(ctxB, opts)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	select {
+	case locked := <-chB:
+		t.Fatalf("Unexpected lock update while lease is held: %v", locked)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Once released the lease is picked up by the second locker
+	cancelA()
+	select {
+	case locked := <-chB:
+		if !locked {
+			t.Fatalf("Expected lock to be acquired")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for lock")
+	}
+
+	// The channel is closed once the context is done
+	cancelB()
+	for range chB {
+	}
+}
+
+func TestK8sLeaseLocker_InvalidTimings(t *testing.T) {
+	l := &K8sLeaseLocker{
+		clientset: fake.NewSimpleClientset(),
+		cfg:       &K8sLeaseConfig{Namespace: "ns", Identity: "a"},
+		lockType:  resourcelock.LeasesResourceLock,
+	}
+	// The lease duration must be longer than the default renew deadline
+	if _, err := l.Lock(context.TODO(), &LockOptions{Key: "targetsync", TTL: time.Second}); err == nil {
+		t.Fatalf("Expected error for a TTL shorter than the renew deadline")
+	}
+}
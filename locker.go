@@ -0,0 +1,88 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NopLocker is a `Locker` which is always the leader, for when only a single
+// instance of targetsync is running
+type NopLocker struct{}
+
+// Lock to implement the Locker interface
+func (NopLocker) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
+	lockedCh := make(chan bool, 1)
+	lockedCh <- true
+	go func() {
+		<-ctx.Done()
+		close(lockedCh)
+	}()
+	return lockedCh, nil
+}
+
+// fileLockRetry is how often to retry acquiring a file lock
+var fileLockRetry = time.Second
+
+// FileLocker is a `Locker` using an flock on a file in a directory, for
+// multiple instances of targetsync on the same host (or a shared filesystem
+// with working flock)
+type FileLocker struct {
+	cfg *FileLockConfig
+}
+
+// NewFileLocker returns a new FileLocker
+func NewFileLocker(cfg *FileLockConfig) (*FileLocker, error) {
+	if err := os.MkdirAll(cfg.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating lock directory: %v", err)
+	}
+	return &FileLocker{cfg: cfg}, nil
+}
+
+// path returns the path of the file to lock for `key`
+func (l *FileLocker) path(key string) string {
+	return filepath.Join(l.cfg.Directory, strings.Replace(key, "/", "_", -1)+".lock")
+}
+
+// Lock to implement the Locker interface. The lock is held until `ctx` is
+// done, at which point the channel is closed
+func (l *FileLocker) Lock(ctx context.Context, opts *LockOptions) (<-chan bool, error) {
+	f, err := os.OpenFile(l.path(opts.Key), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening lock file: %v", err)
+	}
+
+	lockedCh := make(chan bool, 1)
+	go func() {
+		defer close(lockedCh)
+		defer f.Close()
+		for {
+			locked, err := tryLockFile(f)
+			if err != nil {
+				logrus.Errorf("Error acquiring lock: %v", err)
+			}
+			if locked {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(fileLockRetry):
+			}
+		}
+
+		logrus.Infof("Lock acquired")
+		lockedCh <- true
+		<-ctx.Done()
+		logrus.Infof("Context done, releasing lock")
+		if err := unlockFile(f); err != nil {
+			logrus.Errorf("Error releasing lock: %v", err)
+		}
+	}()
+	return lockedCh, nil
+}
@@ -0,0 +1,88 @@
+//go:build !windows
+// +build !windows
+
+package targetsync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNopLocker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := NopLocker{}.Lock(ctx, &LockOptions{Key: "a"})
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	if locked := <-ch; !locked {
+		t.Fatalf("Expected lock to be acquired")
+	}
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatalf("Expected channel to be closed")
+	}
+}
+
+func TestFileLocker(t *testing.T) {
+	fileLockRetry = 10 * time.Millisecond
+	dir, err := ioutil.TempDir("", "targetsync")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	locker, err := NewFileLocker(&FileLockConfig{Directory: dir})
+	if err != nil {
+		t.Fatalf("Error creating locker: %v", err)
+	}
+	opts := &LockOptions{Key: "service/a/leader"}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	chA, err := locker.Lock(ctxA, opts)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	if locked := <-chA; !locked {
+		t.Fatalf("Expected lock to be acquired")
+	}
+
+	// A different key is a different lock
+	ctxOther, cancelOther := context.WithCancel(context.Background())
+	defer cancelOther()
+	chOther, err := locker.Lock(ctxOther, &LockOptions{Key: "service/b/leader"})
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	select {
+	case <-chOther:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for lock")
+	}
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	chB, err := locker.Lock(ctxB, opts)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	select {
+	case <-chB:
+		t.Fatalf("Unexpected lock update while the lock is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once released the lock is picked up by the second locker
+	cancelA()
+	select {
+	case locked := <-chB:
+		if !locked {
+			t.Fatalf("Expected lock to be acquired")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for lock")
+	}
+}
@@ -0,0 +1,248 @@
+package targetsync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sourceUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "targetsync",
+		Name:      "source_updates_total",
+		Help:      "Number of target updates received from the source",
+	}, []string{"pipeline"})
+	targetsAdded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "targetsync",
+		Name:      "targets_added_total",
+		Help:      "Number of targets added to the destination",
+	}, []string{"pipeline", "destination"})
+	targetsRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "targetsync",
+		Name:      "targets_removed_total",
+		Help:      "Number of targets removed from the destination",
+	}, []string{"pipeline", "destination"})
+	removalQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "targetsync",
+		Name:      "removal_queue_depth",
+		Help:      "Number of targets currently scheduled for removal",
+	}, []string{"pipeline", "destination"})
+	destinationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "targetsync",
+		Name:      "destination_request_duration_seconds",
+		Help:      "Latency of requests to the destination",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pipeline", "destination", "operation"})
+	destinationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "targetsync",
+		Name:      "destination_errors_total",
+		Help:      "Number of failed requests to the destination",
+	}, []string{"pipeline", "destination", "operation"})
+	leader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "targetsync",
+		Name:      "leader",
+		Help:      "Whether this process currently holds the lock (1) or not (0)",
+	}, []string{"pipeline"})
+	leaderTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "targetsync",
+		Name:      "leader_transitions_total",
+		Help:      "Number of times the lock was acquired or lost",
+	}, []string{"pipeline"})
+	reconcileFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "targetsync",
+		Name:      "consecutive_failures",
+		Help:      "Number of consecutive failed reconciles",
+	}, []string{"pipeline", "destination"})
+	removalsBlocked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "targetsync",
+		Name:      "removals_blocked",
+		Help:      "Whether removals are currently blocked by the safety thresholds",
+	}, []string{"pipeline", "destination"})
+
+	targetHealth = &targetHealthCollector{
+		desc: prometheus.NewDesc(
+			"targetsync_target_healthy",
+			"Whether each target is healthy at the destination (labelled with its state)",
+			[]string{"pipeline", "destination", "target", "state"}, nil,
+		),
+	}
+
+	lastReconcile = &reconcileAgeCollector{
+		desc: prometheus.NewDesc(
+			"targetsync_seconds_since_last_reconcile",
+			"Seconds since the last successful reconcile (or the pipeline starting)",
+			[]string{"pipeline", "destination"}, nil,
+		),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(
+		sourceUpdates,
+		targetsAdded,
+		targetsRemoved,
+		removalQueueDepth,
+		destinationDuration,
+		destinationErrors,
+		leader,
+		leaderTransitions,
+		reconcileFailures,
+		removalsBlocked,
+		lastReconcile,
+		targetHealth,
+	)
+}
+
+// reconcileAgeCollector reports the time since the last successful reconcile
+// of each destination of each pipeline
+type reconcileAgeCollector struct {
+	desc *prometheus.Desc
+	last sync.Map
+}
+
+// destinationKey identifies a destination of a pipeline
+type destinationKey struct {
+	pipeline, destination string
+}
+
+// Set records a successful reconcile of `destination` in `pipeline` at `t`
+func (c *reconcileAgeCollector) Set(pipeline, destination string, t time.Time) {
+	c.last.Store(destinationKey{pipeline, destination}, t)
+}
+
+// Describe implements prometheus.Collector
+func (c *reconcileAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *reconcileAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.last.Range(func(k, v interface{}) bool {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(v.(time.Time)).Seconds(), k.(destinationKey).pipeline, k.(destinationKey).destination)
+		return true
+	})
+}
+
+// targetHealthCollector reports the last fetched health of the targets of
+// each destination of each pipeline
+type targetHealthCollector struct {
+	desc *prometheus.Desc
+	// l serializes updates so that Remove can't race with Set
+	l      sync.Mutex
+	health sync.Map
+}
+
+// Set records the latest `health` of the targets of `destination` in `pipeline`
+func (c *targetHealthCollector) Set(pipeline, destination string, health []*TargetHealth) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.health.Store(destinationKey{pipeline, destination}, health)
+}
+
+// Remove drops the health of `targets` (which were removed from the destination)
+func (c *targetHealthCollector) Remove(pipeline, destination string, targets []*Target) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	key := destinationKey{pipeline, destination}
+	v, ok := c.health.Load(key)
+	if !ok {
+		return
+	}
+	removed := targetMap(targets)
+	health := make([]*TargetHealth, 0, len(v.([]*TargetHealth)))
+	for _, h := range v.([]*TargetHealth) {
+		if _, ok := removed[h.Target.Key()]; !ok {
+			health = append(health, h)
+		}
+	}
+	c.health.Store(key, health)
+}
+
+// Reset drops the health of all the targets of `destination` in `pipeline`,
+// e.g. once we are no longer the leader and stop fetching it
+func (c *targetHealthCollector) Reset(pipeline, destination string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.health.Delete(destinationKey{pipeline, destination})
+}
+
+// Describe implements prometheus.Collector
+func (c *targetHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *targetHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	c.health.Range(func(k, v interface{}) bool {
+		key := k.(destinationKey)
+		for _, h := range v.([]*TargetHealth) {
+			healthy := 0.0
+			if h.Healthy {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, healthy, key.pipeline, key.destination, h.Target.Key(), h.State)
+		}
+		return true
+	})
+}
+
+// setLeader records whether we are the leader of `pipeline`, counting a
+// transition if that `changed`
+func setLeader(pipeline string, elected, changed bool) {
+	if elected {
+		leader.WithLabelValues(pipeline).Set(1)
+	} else {
+		leader.WithLabelValues(pipeline).Set(0)
+	}
+	if changed {
+		leaderTransitions.WithLabelValues(pipeline).Inc()
+	}
+}
+
+// instrumentedDestination wraps a TargetDestination recording latency and errors
+// of each operation
+type instrumentedDestination struct {
+	TargetDestination
+	pipeline    string
+	destination string
+}
+
+func (d *instrumentedDestination) observe(op string, start time.Time, err error) {
+	destinationDuration.WithLabelValues(d.pipeline, d.destination, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		destinationErrors.WithLabelValues(d.pipeline, d.destination, op).Inc()
+	}
+}
+
+// GetTargets returns the current set of targets at the destination
+func (d *instrumentedDestination) GetTargets(ctx context.Context) ([]*Target, error) {
+	start := time.Now()
+	targets, err := d.TargetDestination.GetTargets(ctx)
+	d.observe("get_targets", start, err)
+	return targets, err
+}
+
+// AddTargets simply adds the targets described
+func (d *instrumentedDestination) AddTargets(ctx context.Context, targets []*Target) error {
+	start := time.Now()
+	err := d.TargetDestination.AddTargets(ctx, targets)
+	d.observe("add_targets", start, err)
+	if err == nil {
+		targetsAdded.WithLabelValues(d.pipeline, d.destination).Add(float64(len(targets)))
+	}
+	return err
+}
+
+// RemoveTargets simply removes the targets described
+func (d *instrumentedDestination) RemoveTargets(ctx context.Context, targets []*Target) error {
+	start := time.Now()
+	err := d.TargetDestination.RemoveTargets(ctx, targets)
+	d.observe("remove_targets", start, err)
+	if err == nil {
+		targetsRemoved.WithLabelValues(d.pipeline, d.destination).Add(float64(len(targets)))
+		targetHealth.Remove(d.pipeline, d.destination, targets)
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pipelines numbers the pipeline names used by the tests, the metrics are
+// global so each run needs its own labels
+var pipelines int64
+
+// testPipeline returns a pipeline name that hasn't been used by another test
+func testPipeline(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, atomic.AddInt64(&pipelines, 1))
+}
+
+// observations returns the number of samples recorded by a histogram
+func observations(t *testing.T, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("Error reading histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// eventually polls `f` until it returns nil or `timeout` passes
+func eventually(t *testing.T, timeout time.Duration, f func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// gaugeEquals returns an error unless the metric `c` has the value `v`
+func gaugeEquals(name string, c prometheus.Collector, v float64) func() error {
+	return func() error {
+		if got := testutil.ToFloat64(c); got != v {
+			return fmt.Errorf("%s: expected %v, got %v", name, v, got)
+		}
+		return nil
+	}
+}
+
+func TestMetrics_sync(t *testing.T) {
+	name := testPipeline("metrics-sync")
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay: 200 * time.Millisecond,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Name:   name,
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		syncer.Run(ctx)
+		close(done)
+	}()
+
+	src.ch <- []*Target{{IP: "1"}, {IP: "2"}}
+	eventually(t, 2*time.Second, gaugeEquals("targets added", targetsAdded.WithLabelValues(name, defaultDestination), 2))
+	if v := testutil.ToFloat64(sourceUpdates.WithLabelValues(name)); v != 1 {
+		t.Errorf("Expected 1 source update, got %v", v)
+	}
+	if v := testutil.ToFloat64(leader.WithLabelValues(name)); v != 1 {
+		t.Errorf("Expected to be reported as leader, got %v", v)
+	}
+	if n := observations(t, destinationDuration.WithLabelValues(name, defaultDestination, "add_targets")); n == 0 {
+		t.Errorf("Expected the latency of add_targets to be recorded")
+	}
+
+	// The removal is queued for RemoveDelay before it is made
+	src.ch <- []*Target{{IP: "1"}}
+	eventually(t, time.Second, gaugeEquals("removal queue depth", removalQueueDepth.WithLabelValues(name, defaultDestination), 1))
+	if v := testutil.ToFloat64(targetsRemoved.WithLabelValues(name, defaultDestination)); v != 0 {
+		t.Errorf("Expected no targets removed before the delay, got %v", v)
+	}
+	eventually(t, 2*time.Second, gaugeEquals("targets removed", targetsRemoved.WithLabelValues(name, defaultDestination), 1))
+	eventually(t, time.Second, gaugeEquals("removal queue depth", removalQueueDepth.WithLabelValues(name, defaultDestination), 0))
+
+	// Stopping the syncer gives up the lock
+	cancel()
+	<-done
+	if v := testutil.ToFloat64(leader.WithLabelValues(name)); v != 0 {
+		t.Errorf("Expected to no longer be reported as leader, got %v", v)
+	}
+	if v := testutil.ToFloat64(leaderTransitions.WithLabelValues(name)); v != 2 {
+		t.Errorf("Expected 2 leader transitions, got %v", v)
+	}
+}
+
+func TestMetrics_leaderFlip(t *testing.T) {
+	name := testPipeline("metrics-leader")
+	syncer := &Syncer{Name: name, Config: &SyncConfig{}}
+
+	syncer.setLeader(true)
+	syncer.setLeader(false)
+	// Only changes in leadership are counted
+	syncer.setLeader(false)
+
+	if v := testutil.ToFloat64(leader.WithLabelValues(name)); v != 0 {
+		t.Errorf("Expected to not be reported as leader, got %v", v)
+	}
+	if v := testutil.ToFloat64(leaderTransitions.WithLabelValues(name)); v != 2 {
+		t.Errorf("Expected 2 leader transitions, got %v", v)
+	}
+}
+
+func TestMetrics_destinationError(t *testing.T) {
+	name := testPipeline("metrics-error")
+	dst := newmockDestination()
+	syncer := &Syncer{Name: name, Config: &SyncConfig{}, Dst: dst}
+	syncer.init()
+	d := syncer.destinations()[0]
+
+	if _, err := d.dst.GetTargets(context.TODO()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dst.setErr(fmt.Errorf("failed"))
+	if _, err := d.dst.GetTargets(context.TODO()); err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	if v := testutil.ToFloat64(destinationErrors.WithLabelValues(name, defaultDestination, "get_targets")); v != 1 {
+		t.Errorf("Expected 1 error, got %v", v)
+	}
+	if n := observations(t, destinationDuration.WithLabelValues(name, defaultDestination, "get_targets")); n != 2 {
+		t.Errorf("Expected the latency of both calls to be recorded, got %d", n)
+	}
+}
+
+func TestReconcileAgeCollector(t *testing.T) {
+	c := &reconcileAgeCollector{desc: lastReconcile.desc}
+	c.Set("a", defaultDestination, time.Now().Add(-10*time.Second))
+
+	if v := testutil.ToFloat64(c); math.Abs(v-10) > 1 {
+		t.Errorf("Expected about 10s since the last reconcile, got %v", v)
+	}
+}
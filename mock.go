@@ -4,11 +4,15 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
-type mockLocker struct{}
+type mockLocker struct {
+	locks int64
+}
 
 func (m *mockLocker) Lock(context.Context, *LockOptions) (<-chan bool, error) {
+	atomic.AddInt64(&m.locks, 1)
 	ch := make(chan bool, 1)
 	ch <- true
 	return ch, nil
@@ -36,13 +40,54 @@ func newmockDestination() *mockDestination {
 
 type mockDestination struct {
 	targets []*Target
-	l       sync.RWMutex
+	err     error
+	// number of calls to RemoveTargets
+	removeCalls int
+	// targets (by key) which are rejected by AddTargets
+	invalid map[string]bool
+	// targets (by key) which are reported as unhealthy
+	unhealthy map[string]bool
+	l         sync.RWMutex
+}
+
+// setHealthy sets whether the target `key` is reported as healthy
+func (m *mockDestination) setHealthy(key string, healthy bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.unhealthy == nil {
+		m.unhealthy = make(map[string]bool)
+	}
+	m.unhealthy[key] = !healthy
+}
+
+// GetTargetHealth returns the health of each target at the destination
+func (m *mockDestination) GetTargetHealth(context.Context) ([]*TargetHealth, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	health := make([]*TargetHealth, len(m.targets))
+	for i, target := range m.targets {
+		health[i] = &TargetHealth{Target: target, Healthy: !m.unhealthy[target.Key()]}
+	}
+	return health, nil
+}
+
+// setErr sets an error to be returned from all calls to the destination
+func (m *mockDestination) setErr(err error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.err = err
 }
 
 // GetTargets returns the current set of targets at the destination
 func (m *mockDestination) GetTargets(context.Context) ([]*Target, error) {
 	m.l.RLock()
 	defer m.l.RUnlock()
+	if m.err != nil {
+		return nil, m.err
+	}
 	return m.targets, nil
 }
 
@@ -50,6 +95,14 @@ func (m *mockDestination) GetTargets(context.Context) ([]*Target, error) {
 func (m *mockDestination) AddTargets(_ context.Context, tgts []*Target) error {
 	m.l.Lock()
 	defer m.l.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	for _, tgt := range tgts {
+		if m.invalid[tgt.Key()] {
+			return fmt.Errorf("%w: %s", ErrInvalidTarget, tgt.Key())
+		}
+	}
 	m.targets = append(m.targets, tgts...)
 	return nil
 }
@@ -58,6 +111,10 @@ func (m *mockDestination) AddTargets(_ context.Context, tgts []*Target) error {
 func (m *mockDestination) RemoveTargets(_ context.Context, tgts []*Target) error {
 	m.l.Lock()
 	defer m.l.Unlock()
+	m.removeCalls++
+	if m.err != nil {
+		return m.err
+	}
 
 	for _, tgt := range tgts {
 		foundIdx := -1
@@ -74,3 +131,23 @@ func (m *mockDestination) RemoveTargets(_ context.Context, tgts []*Target) error
 	}
 	return nil
 }
+
+// mockMappedDestination is a mockDestination which registers all targets on `port`
+type mockMappedDestination struct {
+	*mockDestination
+	port int
+}
+
+// MapTargets overrides the port of the targets
+func (m *mockMappedDestination) MapTargets(targets []*Target) []*Target {
+	mapped := make([]*Target, 0, len(targets))
+	seen := make(map[string]struct{})
+	for _, target := range targets {
+		t := target.withPort(m.port)
+		if _, ok := seen[t.Key()]; !ok {
+			seen[t.Key()] = struct{}{}
+			mapped = append(mapped, t)
+		}
+	}
+	return mapped
+}
@@ -2,61 +2,306 @@ package targetsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jacksontj/lane"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	// healthCheckInterval is how often the health of new targets is checked
+	// while removals are deferred
+	healthCheckInterval = 5 * time.Second
+	// healthPollInterval is how often the leader fetches the health of the
+	// targets for the metrics
+	healthPollInterval = 30 * time.Second
+)
+
+var (
+	// ErrTooManyFailures is returned when the leader has failed `MaxFailures` times in a row
+	ErrTooManyFailures = errors.New("too many consecutive leader failures")
+	// ErrRemovalsBlocked is returned when removals were refused by the safety thresholds
+	ErrRemovalsBlocked = errors.New("removals blocked by safety thresholds")
+)
+
 // Syncer is the struct that uses the various interfaces to actually do the sync
-// TODO: metrics
 type Syncer struct {
+	// Name of the pipeline this syncer is running, used for metrics and logging
+	Name      string
 	Config    *SyncConfig
 	LocalAddr string
 	Locker    Locker
 	Src       TargetSource
-	Dst       TargetDestination
-	Started   bool
+	// Dst is the destination to sync to, alternatively Dsts may be set to sync
+	// the source to multiple named destinations. Each destination is reconciled
+	// independently so an error in one doesn't hold up the others
+	Dst     TargetDestination
+	Dsts    map[string]TargetDestination
+	Started bool
+
+	l      sync.RWMutex
+	leader bool
+	dsts   []*destination
+}
+
+// SyncerStatus is a snapshot of the state of a Syncer
+type SyncerStatus struct {
+	Name                string              `json:"name"`
+	Started             bool                `json:"started"`
+	Leader              bool                `json:"leader"`
+	DryRun              bool                `json:"dry_run"`
+	ConsecutiveFailures int                 `json:"consecutive_failures"`
+	RemovalsBlocked     string              `json:"removals_blocked,omitempty"`
+	Destinations        []DestinationStatus `json:"destinations"`
+}
+
+// Status returns the current status of the syncer
+func (s *Syncer) Status() SyncerStatus {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	status := SyncerStatus{
+		Name:         s.Name,
+		Started:      s.Started,
+		Leader:       s.leader,
+		DryRun:       s.Config.DryRun,
+		Destinations: make([]DestinationStatus, 0, len(s.dsts)),
+	}
+	blocked := make([]string, 0)
+	for _, d := range s.dsts {
+		dstStatus := d.status()
+		status.Destinations = append(status.Destinations, dstStatus)
+		if dstStatus.ConsecutiveFailures > status.ConsecutiveFailures {
+			status.ConsecutiveFailures = dstStatus.ConsecutiveFailures
+		}
+		if dstStatus.RemovalsBlocked != "" {
+			blocked = append(blocked, fmt.Sprintf("%s: %s", d.name, dstStatus.RemovalsBlocked))
+		}
+	}
+	status.RemovalsBlocked = strings.Join(blocked, "; ")
+	return status
+}
+
+// DryRunChanges returns the changes that would have been made to the destinations
+// (nil if not running in dry-run mode)
+func (s *Syncer) DryRunChanges() []DryRunChange {
+	var changes []DryRunChange
+	for _, d := range s.destinations() {
+		if d.dryRun != nil {
+			changes = append(changes, d.dryRun.Changes()...)
+		}
+	}
+	return changes
+}
+
+// TargetHealth fetches the health of the targets of each destination which
+// reports health
+func (s *Syncer) TargetHealth(ctx context.Context) []*DestinationHealth {
+	health := make([]*DestinationHealth, 0)
+	for _, d := range s.destinations() {
+		if d.health == nil {
+			continue
+		}
+		dstHealth := &DestinationHealth{Destination: d.name}
+		targets, err := d.targetHealth(ctx)
+		if err != nil {
+			dstHealth.Error = err.Error()
+		} else {
+			sort.Slice(targets, func(i, j int) bool { return targets[i].Target.Key() < targets[j].Target.Key() })
+			dstHealth.Targets = targets
+		}
+		health = append(health, dstHealth)
+	}
+	return health
+}
+
+// setLeader records whether we are currently the leader
+func (s *Syncer) setLeader(elected bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	changed := s.leader != elected
+	s.leader = elected
+	setLeader(s.Name, elected, changed)
+	if !elected {
+		// The health is only kept up to date by the leader
+		for _, d := range s.dsts {
+			targetHealth.Reset(s.Name, d.name)
+		}
+	}
+}
+
+// log returns a logger annotated with the pipeline name
+func (s *Syncer) log() *logrus.Entry {
+	return logrus.WithField("pipeline", s.Name)
 }
 
-// syncSelf simply syncs the LocalAddr from the souce to the target
+// syncSelf simply syncs the LocalAddr from the souce to the targets
 func (s *Syncer) syncSelf(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	logrus.Infof("Local Addr %s -- waiting until added to target", s.LocalAddr)
+	s.log().Infof("Local Addr %s -- waiting until added to target", s.LocalAddr)
 	srcCh, err := s.Src.Subscribe(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Now we wait until our IP shows up in the source data, once it does
-	// we add ourselves to the target
+	// we add ourselves to the targets
 	for {
-		logrus.Debugf("Waiting for targets from source")
+		s.log().Debugf("Waiting for targets from source")
 		var srcTargets []*Target
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case srcTargets = <-srcCh:
 		}
-		logrus.Debugf("Received targets from source: %+#v", srcTargets)
+		s.log().Debugf("Received targets from source: %+#v", srcTargets)
 
 		for _, target := range srcTargets {
 			if target.IP == s.LocalAddr {
 				// try adding ourselves
-				if err := s.Dst.AddTargets(ctx, []*Target{target}); err != nil {
-					return err
+				var errs DestinationErrors
+				for _, d := range s.destinations() {
+					if err := d.dst.AddTargets(ctx, d.targets([]*Target{target})); err != nil {
+						errs = append(errs, &DestinationError{Destination: d.name, Err: err})
+					}
 				}
-				return nil
+				return errs.err()
 			}
 		}
 	}
 }
 
+// init sets up the destinations, wrapping them with metrics (and dry-run if enabled)
+func (s *Syncer) init() {
+	if s.Config.DryRun {
+		s.log().Warnf("Running in dry-run mode, no changes will be made to the destination")
+	}
+
+	dsts := make([]*destination, 0, len(s.Dsts)+1)
+	if s.Dst != nil {
+		dsts = append(dsts, newDestination(s.Name, defaultDestination, s.Dst, s.Config.DryRun))
+	}
+	for name, dst := range s.Dsts {
+		dsts = append(dsts, newDestination(s.Name, name, dst, s.Config.DryRun))
+	}
+	sort.Slice(dsts, func(i, j int) bool { return dsts[i].name < dsts[j].name })
+
+	s.l.Lock()
+	s.dsts = dsts
+	s.l.Unlock()
+}
+
+// destinations returns the destinations set up by init
+func (s *Syncer) destinations() []*destination {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.dsts
+}
+
+// snapshot fetches the current targets from the source
+func (s *Syncer) snapshot(ctx context.Context) ([]*Target, error) {
+	srcTargets, err := Snapshot(ctx, s.Src)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching targets from source: %v", err)
+	}
+	return srcTargets, nil
+}
+
+// Diff takes a single snapshot of the source and each destination and returns
+// the changes required to bring the destinations in sync
+func (s *Syncer) Diff(ctx context.Context) ([]*TargetDiff, error) {
+	s.init()
+	srcTargets, err := s.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs DestinationErrors
+	diffs := make([]*TargetDiff, 0, len(s.destinations()))
+	for _, d := range s.destinations() {
+		dstTargets, err := d.dst.GetTargets(ctx)
+		if err != nil {
+			errs = append(errs, &DestinationError{Destination: d.name, Err: fmt.Errorf("Error fetching targets from destination: %v", err)})
+			continue
+		}
+		diff := DiffTargets(d.targets(srcTargets), dstTargets)
+		diff.Destination = d.name
+		diffs = append(diffs, diff)
+	}
+	return diffs, errs.err()
+}
+
+// SyncOnce applies a single diff of the source against each destination and
+// returns them. Unlike Run this doesn't take the lock and removals are done
+// immediately (still subject to the safety thresholds)
+func (s *Syncer) SyncOnce(ctx context.Context) ([]*TargetDiff, error) {
+	s.init()
+	srcTargets, err := s.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs DestinationErrors
+	diffs := make([]*TargetDiff, 0, len(s.destinations()))
+	for _, d := range s.destinations() {
+		diff, err := s.syncOnce(ctx, d, d.targets(srcTargets))
+		if diff != nil {
+			diffs = append(diffs, diff)
+		}
+		if err != nil {
+			errs = append(errs, &DestinationError{Destination: d.name, Err: err})
+		}
+	}
+	return diffs, errs.err()
+}
+
+// syncOnce applies a single diff of `srcTargets` against the destination `d`
+func (s *Syncer) syncOnce(ctx context.Context, d *destination, srcTargets []*Target) (*TargetDiff, error) {
+	dstTargets, err := d.dst.GetTargets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching targets from destination: %v", err)
+	}
+	diff := DiffTargets(srcTargets, dstTargets)
+	diff.Destination = d.name
+
+	if len(diff.Add) > 0 {
+		d.log.Infof("Adding targets to destination: %v", diff.Add)
+		if err := s.addTargets(ctx, d, diff.Add); err != nil {
+			return diff, fmt.Errorf("Error adding targets: %v", err)
+		}
+	}
+	if err := s.checkRemovals(len(dstTargets)+len(diff.Add), len(diff.Remove)); err != nil {
+		d.setRemovalsBlocked(err.Error())
+		return diff, fmt.Errorf("%w: %v", ErrRemovalsBlocked, err)
+	}
+	if len(diff.Remove) > 0 {
+		d.log.Infof("Removing targets from destination: %v", diff.Remove)
+		if err := d.dst.RemoveTargets(ctx, diff.Remove); err != nil {
+			return diff, fmt.Errorf("Error removing targets: %v", err)
+		}
+	}
+	return diff, nil
+}
+
 // Run is the main method for the syncer. This is responsible for calling
 // runLeader when the lock is held
 func (s *Syncer) Run(ctx context.Context) error {
+	s.init()
+	if s.Config.RemoveDelay > 0 && s.Config.RemoveDelay < s.Config.LockOptions.TTL {
+		// A new leader starts with an empty removal queue, so a delay shorter
+		// than a leadership handover doesn't protect against flapping targets
+		s.log().Warnf("remove_delay (%v) is shorter than the lock TTL (%v), targets may be removed early after a change of leader", s.Config.RemoveDelay, s.Config.LockOptions.TTL)
+	}
+	for _, d := range s.destinations() {
+		lastReconcile.Set(s.Name, d.name, time.Now())
+	}
+
 	// add ourselves if a LocalAddr was defined
 	if s.LocalAddr != "" {
 		if err := s.syncSelf(ctx); err != nil {
@@ -64,55 +309,163 @@ func (s *Syncer) Run(ctx context.Context) error {
 		}
 	}
 
+	s.l.Lock()
 	s.Started = true
-	logrus.Debugf("Syncer creating lock: %v", s.Config.LockOptions)
-	electedCh, err := s.Locker.Lock(ctx, &s.Config.LockOptions)
+	s.l.Unlock()
+	for {
+		err := s.runLocked(ctx)
+		if err != ErrTooManyFailures {
+			return err
+		}
+
+		// We released the lock, give the other replicas a chance to acquire it
+		// before we try again
+		s.log().Warnf("Lock released after %d consecutive failures, waiting %v before re-acquiring", s.Config.MaxFailures, s.Config.LockOptions.TTL)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.Config.LockOptions.TTL):
+		}
+	}
+}
+
+// runLocked acquires the lock and calls runLeader while it is held. This returns
+// ErrTooManyFailures (after releasing the lock) if the leader failed `MaxFailures`
+// consecutive times
+func (s *Syncer) runLocked(ctx context.Context) error {
+	lockCtx, lockCtxCancel := context.WithCancel(ctx)
+	defer lockCtxCancel()
+
+	s.log().Debugf("Syncer creating lock: %v", s.Config.LockOptions)
+	electedCh, err := s.Locker.Lock(lockCtx, &s.Config.LockOptions)
 	if err != nil {
 		return err
 	}
+	defer s.setLeader(false)
 
-	var leaderCtx context.Context
 	var leaderCtxCancel context.CancelFunc
+	stopLeader := func() {
+		if leaderCtxCancel != nil {
+			leaderCtxCancel()
+			leaderCtxCancel = nil
+		}
+	}
+	defer stopLeader()
+
+	leaderErrCh := make(chan error, 1)
 
 	for {
 		select {
 		case <-ctx.Done():
-			if leaderCtxCancel != nil {
-				leaderCtxCancel()
-			}
 			return ctx.Err()
 		case elected, ok := <-electedCh:
 			if !ok {
 				return fmt.Errorf("Lock channel closed")
 			}
+			s.setLeader(elected)
 			if elected {
-				leaderCtx, leaderCtxCancel = context.WithCancel(ctx)
-				logrus.Infof("Lock acquired, starting leader actions")
-				go s.runLeader(leaderCtx)
+				stopLeader()
+				leaderCtx, cancel := context.WithCancel(lockCtx)
+				leaderCtxCancel = cancel
+				s.log().Infof("Lock acquired, starting leader actions")
+				go func(ctx context.Context) {
+					err := s.runLeader(ctx)
+					// Only report errors from a leader that wasn't stopped
+					if ctx.Err() == nil {
+						leaderErrCh <- err
+					}
+				}(leaderCtx)
 			} else {
-				logrus.Infof("Lock lost, stopping leader actions")
-				if leaderCtxCancel != nil {
-					leaderCtxCancel()
-				}
+				s.log().Infof("Lock lost, stopping leader actions")
+				stopLeader()
 			}
+		case err := <-leaderErrCh:
+			s.log().Errorf("Leader actions failed: %v", err)
+			return err
 		}
 	}
 }
 
+// ConsecutiveFailures returns the most reconciles that have failed in a row
+// for any of the destinations
+func (s *Syncer) ConsecutiveFailures() int {
+	failures := 0
+	for _, d := range s.destinations() {
+		if f := d.consecutiveFailures(); f > failures {
+			failures = f
+		}
+	}
+	return failures
+}
+
+// leaderFailed records a failure of the leader loop for `dsts`. This returns how
+// long to wait before retrying, or ErrTooManyFailures if the leader should give
+// up as every destination (which hasn't stopped) has failed `MaxFailures` times
+// in a row
+func (s *Syncer) leaderFailed(log *logrus.Entry, err error, dsts ...*destination) (time.Duration, error) {
+	failures := 0
+	for _, d := range dsts {
+		if f := d.failed(); f > failures {
+			failures = f
+		}
+	}
+	if s.Config.MaxFailures > 0 {
+		active, exhausted := 0, true
+		for _, d := range s.destinations() {
+			// Stopped destinations no longer fail, so they can't hold on to the lock
+			if d.stopped() {
+				continue
+			}
+			active++
+			if d.consecutiveFailures() < s.Config.MaxFailures {
+				exhausted = false
+				break
+			}
+		}
+		if active > 0 && exhausted {
+			return 0, ErrTooManyFailures
+		}
+	}
+	retry := s.Config.retryBackoff(failures)
+	log.Errorf("Leader action failed (%d consecutive failures), retrying in %v: %v", failures, retry, err)
+	return retry, nil
+}
+
 // bgRemove is a background goroutine responsible for removing targets from the destination
 // this exists to allow for a `RemoveDelay` on the removal of targets from the destination
 // to avoid issues where a target is "flapping" in the source
-func (s *Syncer) bgRemove(ctx context.Context, removeCh chan *Target, addCh chan *Target) {
+func (s *Syncer) bgRemove(ctx context.Context, d *destination, removeCh chan *Target, addCh chan *Target) {
 	itemMap := make(map[string]*lane.Item)
 	q := lane.NewPQueue(lane.MINPQ)
 
 	defaultDuration := time.Hour
+	// number of consecutive failed removals
+	failures := 0
+
+	// Whether removals are deferred until the new targets are healthy is
+	// checked in the background before each batch, as it calls the
+	// destination. The result is sent on healthCh and used for one batch
+	var healthCh chan bool
+	checked, deferRemovals := false, false
 
 	t := time.NewTimer(defaultDuration)
+	// the queue is discarded when we stop
+	defer removalQueueDepth.WithLabelValues(s.Name, d.name).Set(0)
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case awaiting := <-healthCh:
+			healthCh = nil
+			checked, deferRemovals = true, awaiting
+			// Process the due removals now that we know
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(0)
 		case toRemove, ok := <-removeCh:
 			if !ok {
 				continue
@@ -123,7 +476,7 @@ func (s *Syncer) bgRemove(ctx context.Context, removeCh chan *Target, addCh chan
 				continue
 			}
 
-			logrus.Debugf("Scheduling target for removal from destination in %v: %v", s.Config.RemoveDelay, toRemove)
+			d.log.Debugf("Scheduling target for removal from destination in %v: %v", s.Config.RemoveDelay, toRemove)
 			now := time.Now()
 			removeUnixTime := now.Add(s.Config.RemoveDelay).Unix()
 			if headItem, headAt := q.Head(); headItem == nil || removeUnixTime < headAt {
@@ -136,91 +489,190 @@ func (s *Syncer) bgRemove(ctx context.Context, removeCh chan *Target, addCh chan
 				t.Reset(s.Config.RemoveDelay)
 			}
 			itemMap[toRemove.Key()] = q.Push(toRemove, removeUnixTime)
+			removalQueueDepth.WithLabelValues(s.Name, d.name).Set(float64(len(itemMap)))
 		case toAdd, ok := <-addCh:
 			if !ok {
 				continue
 			}
 			key := toAdd.Key()
 			if item, ok := itemMap[key]; ok {
-				logrus.Debugf("Removing target from removal queue as it was re-added: %v", toAdd)
+				d.log.Debugf("Removing target from removal queue as it was re-added: %v", toAdd)
 				q.Remove(item)
 				delete(itemMap, key)
+				removalQueueDepth.WithLabelValues(s.Name, d.name).Set(float64(len(itemMap)))
 			}
 		case <-t.C:
-			// Check if there is an item at head, and if the time is past then
-			// do the removal
-			headItem, headUnixTime := q.Head()
-			logrus.Debugf("Processing target removal: %v", headItem)
 			now := time.Now()
 			nowUnix := now.Unix()
+			if s.Config.WaitForHealthy && !checked {
+				if headItem, headUnixTime := q.Head(); headItem != nil && headUnixTime <= nowUnix {
+					// The timer is reset once the check is done
+					if healthCh == nil {
+						healthCh = make(chan bool, 1)
+						go func(ch chan bool) {
+							ch <- d.awaitingHealthy(ctx, s.Config.healthyTimeout())
+						}(healthCh)
+					}
+					continue
+				}
+			}
 
-		DELETE_LOOP:
-			for headItem != nil {
-				// If we where woken before something is ready, just reschedule
-				if headUnixTime > nowUnix {
-					break DELETE_LOOP
-				} else {
-					target := headItem.(*Target)
-					if err := s.Dst.RemoveTargets(ctx, []*Target{target}); err == nil {
-						logrus.Debugf("Target removal successful: %v", target)
-						q.Pop()
+			// Pop every target which is due for removal so they can be
+			// removed in a single batch
+			due := make([]*Target, 0)
+			dueAt := make([]int64, 0)
+			for headItem, headUnixTime := q.Head(); headItem != nil && headUnixTime <= nowUnix; headItem, headUnixTime = q.Head() {
+				q.Pop()
+				due = append(due, headItem.(*Target))
+				dueAt = append(dueAt, headUnixTime)
+			}
+
+			var retry time.Duration
+			awaiting := checked && deferRemovals
+			checked = false
+			if len(due) > 0 && awaiting {
+				// Put the targets back in the queue until the new targets are healthy
+				retry = healthCheckInterval
+				for i, target := range due {
+					itemMap[target.Key()] = q.Push(target, dueAt[i])
+				}
+			} else if len(due) > 0 {
+				d.log.Debugf("Processing target removals: %v", due)
+				if err := d.dst.RemoveTargets(ctx, due); err == nil {
+					d.log.Debugf("Target removal successful: %v", due)
+					failures = 0
+					for _, target := range due {
 						delete(itemMap, target.Key())
-					} else {
-						logrus.Errorf("Target removal unsuccessful %v: %v", target, err)
-						break DELETE_LOOP
+					}
+					removalQueueDepth.WithLabelValues(s.Name, d.name).Set(float64(len(itemMap)))
+				} else {
+					// Put the targets back in the queue to try again later
+					failures++
+					retry = s.Config.retryBackoff(failures)
+					d.log.Errorf("Target removal unsuccessful, retrying in %v %v: %v", retry, due, err)
+					for i, target := range due {
+						itemMap[target.Key()] = q.Push(target, dueAt[i])
 					}
 				}
-				headItem, headUnixTime = q.Head()
 			}
+
 			// If there is still an item in the queue, reset the timer
-			if headItem != nil {
-				d := time.Unix(headUnixTime, 0).Sub(now)
-				if !t.Stop() {
-					select {
-					case <-t.C:
-					default:
-					}
+			if headItem, headUnixTime := q.Head(); headItem != nil {
+				next := time.Unix(headUnixTime, 0).Sub(now)
+				if next < retry {
+					next = retry
 				}
-				t.Reset(d)
+				t.Reset(next)
 			}
 		}
 	}
 }
 
-// runLeader does the actual syncing from source to destination. This is called
+// runLeader does the actual syncing from source to destinations. This is called
 // after the leader election has been done, there should only be one of these per
 // unique destination running globally
 func (s *Syncer) runLeader(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	removeCh := make(chan *Target, 100)
-	addCh := make(chan *Target, 100)
-	defer close(removeCh)
-	defer close(addCh)
-	go s.bgRemove(ctx, removeCh, addCh)
+	// Each destination is reconciled in its own goroutine from the same
+	// subscription so that a slow or failing destination doesn't block the others
+	dsts := s.destinations()
+	dstChs := make([]chan []*Target, len(dsts))
+	errCh := make(chan error, len(dsts))
+	for i, d := range dsts {
+		d.resetFailures()
+		d.setStopped(nil)
+		dstChs[i] = make(chan []*Target, 1)
+		go func(d *destination, ch chan []*Target) {
+			errCh <- s.runDestination(ctx, d, ch)
+		}(d, dstChs[i])
+	}
 
 	// get state from source
-	srcCh, err := s.Src.Subscribe(ctx)
+	srcCh, err := s.subscribe(ctx)
 	if err != nil {
 		return err
 	}
+	// number of destinations which have stopped syncing
+	stopped := 0
+
+	// Wait for an update, if we get one pass it on to the destinations
+	for {
+		s.log().Debugf("Waiting for targets from source")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errCh:
+			if !errors.Is(err, ErrDestinationNotFound) {
+				return err
+			}
+			// Keep syncing the other destinations as long as there are any
+			if stopped++; stopped == len(dsts) {
+				return err
+			}
+		case targets, ok := <-srcCh:
+			if !ok {
+				// The subscription ended, re-subscribe and wait for a fresh
+				// set of targets before doing anything else
+				s.log().Errorf("Source subscription closed, re-subscribing")
+				if srcCh, err = s.subscribe(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			sourceUpdates.WithLabelValues(s.Name).Inc()
+			s.log().Debugf("Received targets from source: %+#v", targets)
+			for _, ch := range dstChs {
+				// Replace any update the destination hasn't picked up yet, it
+				// only needs the latest set of targets
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- targets
+			}
+		}
+	}
+}
+
+// runDestination reconciles the destination `d` with each set of targets from
+// `srcCh`, and periodically to pick up changes made to the destination
+func (s *Syncer) runDestination(ctx context.Context, d *destination, srcCh chan []*Target) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	removeCh := make(chan *Target, 100)
+	addCh := make(chan *Target, 100)
+	go s.bgRemove(ctx, d, removeCh, addCh)
+
 	var srcTargets []*Target
 
+	// Keep the target health metrics up to date
+	var healthCh <-chan time.Time
+	if d.health != nil {
+		ticker := time.NewTicker(healthPollInterval)
+		defer ticker.Stop()
+		healthCh = ticker.C
+	}
+
 	// Check for destination changes every 15 minutes
 	// (timer initialized to inf to ensure source gets initialized first)
-	d := time.Minute * 15
+	dur := time.Minute * 15
 	t := time.NewTimer(time.Second * (1 << 32))
 	defer t.Stop()
 
-	// Wait for an update, if we get one sync it
 	for {
-		logrus.Debugf("Waiting for targets from source")
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case srcTargets = <-srcCh:
-			logrus.Debugf("Received targets from source: %+#v", srcTargets)
+		case targets := <-srcCh:
+			srcTargets = d.targets(targets)
+		case <-healthCh:
+			if _, err := d.targetHealth(ctx); err != nil {
+				d.log.Errorf("Error fetching target health: %v", err)
+			}
+			continue
 		case <-t.C:
 		}
 		if !t.Stop() {
@@ -229,48 +681,146 @@ func (s *Syncer) runLeader(ctx context.Context) error {
 			default:
 			}
 		}
-		t.Reset(d)
 
-		// get current ones from dst
-		dstTargets, err := s.Dst.GetTargets(ctx)
-		if err != nil {
-			return err
+		if err := s.reconcile(ctx, d, srcTargets, addCh, removeCh); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var retry time.Duration
+			switch {
+			case errors.Is(err, ErrDestinationNotFound):
+				// Retrying won't help, so stop syncing this destination
+				d.log.Errorf("Destination not found, no longer syncing it: %v", err)
+				d.setStopped(err)
+				return err
+			case errors.Is(err, ErrThrottled):
+				// Releasing the lock won't help as the other replicas share the
+				// same rate limit, so wait as long as we would for any failure
+				d.failed()
+				retry = s.Config.retryBackoff(math.MaxInt32)
+				d.log.Warnf("Destination throttled, retrying in %v: %v", retry, err)
+			default:
+				if retry, err = s.leaderFailed(d.log, err, d); err != nil {
+					return err
+				}
+			}
+			t.Reset(retry)
+			continue
 		}
-		logrus.Debugf("Fetched targets from destination: %+#v", dstTargets)
+		d.succeeded()
+		t.Reset(dur)
+	}
+}
 
-		// TODO: compare ports and do something with them
-		srcMap := make(map[string]*Target)
-		for _, target := range srcTargets {
-			srcMap[target.IP] = target
+// subscribe subscribes to the source, retrying with backoff on failure
+func (s *Syncer) subscribe(ctx context.Context) (chan []*Target, error) {
+	for {
+		srcCh, err := s.Src.Subscribe(ctx)
+		if err == nil {
+			return srcCh, nil
 		}
-		dstMap := make(map[string]*Target)
-		for _, target := range dstTargets {
-			dstMap[target.IP] = target
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// None of the destinations can be reconciled without the source
+		retry, err := s.leaderFailed(s.log(), err, s.destinations()...)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry):
 		}
+	}
+}
 
-		// Add hosts first
-		hostsToAdd := make([]*Target, 0)
-		for ip, target := range srcMap {
-			// We want to ensure that any target we think should be alive isn't
-			// in the removal queue
-			addCh <- target
+// reconcile applies a single diff of `srcTargets` against the destination `d`
+func (s *Syncer) reconcile(ctx context.Context, d *destination, srcTargets []*Target, addCh, removeCh chan *Target) error {
+	// get current ones from dst
+	dstTargets, err := d.dst.GetTargets(ctx)
+	if err != nil {
+		return err
+	}
+	d.log.Debugf("Fetched targets from destination: %+#v", dstTargets)
 
-			if _, ok := dstMap[ip]; !ok {
-				hostsToAdd = append(hostsToAdd, target)
-			}
+	// Targets are keyed by IP+Port so that a host running multiple
+	// instances (or an instance moving to a new port) is reconciled
+	diff := DiffTargets(srcTargets, dstTargets)
+	if d.dryRun != nil {
+		d.dryRun.prune(srcTargets)
+	}
+
+	// We want to ensure that any target we think should be alive isn't
+	// in the removal queue
+	for _, target := range srcTargets {
+		addCh <- target
+	}
+
+	// Add hosts first
+	if len(diff.Add) > 0 {
+		d.log.Debugf("Adding targets to destination: %v", diff.Add)
+		if err := s.addTargets(ctx, d, diff.Add); err != nil {
+			return err
 		}
-		if len(hostsToAdd) > 0 {
-			logrus.Debugf("Adding targets to destination: %v", hostsToAdd)
-			if err := s.Dst.AddTargets(ctx, hostsToAdd); err != nil {
-				return err
-			}
+	}
+	// Nothing is actually added in dry-run mode, so there is nothing to wait for
+	if s.Config.WaitForHealthy && d.dryRun == nil {
+		d.addPendingHealthy(diff.Add, srcTargets)
+	}
+
+	// Remove hosts last
+	if err := s.checkRemovals(len(dstTargets)+len(diff.Add), len(diff.Remove)); err != nil {
+		d.log.Errorf("Refusing to remove %d targets from destination: %v", len(diff.Remove), err)
+		d.setRemovalsBlocked(err.Error())
+		// Ensure nothing scheduled by a previous reconcile gets removed either
+		for _, target := range diff.Remove {
+			addCh <- target
 		}
+		return nil
+	}
+	d.setRemovalsBlocked("")
+	for _, target := range diff.Remove {
+		removeCh <- target
+	}
+	return nil
+}
+
+// addTargets adds `targets` to the destination `d`. If some of the targets are
+// invalid they are added one at a time so that the rest are still added
+func (s *Syncer) addTargets(ctx context.Context, d *destination, targets []*Target) error {
+	err := d.dst.AddTargets(ctx, targets)
+	if !errors.Is(err, ErrInvalidTarget) || len(targets) == 1 {
+		return err
+	}
 
-		// Remove hosts last
-		for ip, target := range dstMap {
-			if _, ok := srcMap[ip]; !ok {
-				removeCh <- target
+	d.log.Warnf("Invalid target in batch, adding targets individually: %v", err)
+	for _, target := range targets {
+		if err := d.dst.AddTargets(ctx, []*Target{target}); err != nil {
+			if !errors.Is(err, ErrInvalidTarget) {
+				return err
 			}
+			d.log.Errorf("Skipping invalid target %s: %v", target.Key(), err)
 		}
 	}
+	return nil
+}
+
+// checkRemovals checks the safety thresholds for removing `remove` of the
+// `total` targets in the destination
+func (s *Syncer) checkRemovals(total, remove int) error {
+	if remove == 0 {
+		return nil
+	}
+	remaining := total - remove
+	if s.Config.PreventEmpty && remaining <= 0 {
+		return fmt.Errorf("removal would leave the destination empty")
+	}
+	if remaining < s.Config.MinTargets {
+		return fmt.Errorf("removal would leave %d targets, below the minimum of %d", remaining, s.Config.MinTargets)
+	}
+	if s.Config.MaxRemoveFraction > 0 && float64(remove)/float64(total) > s.Config.MaxRemoveFraction {
+		return fmt.Errorf("removal of %d/%d targets exceeds the maximum fraction of %v", remove, total, s.Config.MaxRemoveFraction)
+	}
+	return nil
 }
@@ -2,7 +2,9 @@ package targetsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -136,3 +138,747 @@ func TestSyncer_Races(t *testing.T) {
 		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, target, tgts)
 	}
 }
+
+// TestSyncer_MultiPort checks that multiple targets on the same host (different ports) are all synced
+func TestSyncer_MultiPort(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay: time.Second,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	targets := []*Target{
+		{IP: "1", Port: 80},
+		{IP: "1", Port: 81},
+		{IP: "2", Port: 80},
+	}
+	target := []*Target{targets[0], targets[2]}
+
+	// set targets
+	src.ch <- targets
+	time.Sleep(time.Second)
+
+	// check that they match
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(targets, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, targets, tgts)
+	}
+
+	// remove one of the ports from the host
+	src.ch <- target
+	time.Sleep(time.Second * 2)
+
+	// check that they match
+	tgts, _ = dst.GetTargets(nil)
+	if err := equalTargets(target, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, target, tgts)
+	}
+}
+
+// TestSyncer_PortMigration checks that a target changing ports is re-registered on the new
+// port and the old port is removed after the RemoveDelay
+func TestSyncer_PortMigration(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay: time.Second,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	oldTarget := []*Target{{IP: "1", Port: 80}}
+	newTarget := []*Target{{IP: "1", Port: 8080}}
+	both := []*Target{oldTarget[0], newTarget[0]}
+
+	src.ch <- oldTarget
+	time.Sleep(time.Second)
+
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(oldTarget, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, oldTarget, tgts)
+	}
+
+	// move the target to a new port, the new port should be added immediately
+	// and the old port should stick around until the RemoveDelay
+	src.ch <- newTarget
+	time.Sleep(time.Millisecond * 300)
+
+	tgts, _ = dst.GetTargets(nil)
+	if err := equalTargets(both, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, both, tgts)
+	}
+
+	time.Sleep(time.Second * 2)
+
+	tgts, _ = dst.GetTargets(nil)
+	if err := equalTargets(newTarget, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, newTarget, tgts)
+	}
+}
+
+// TestSyncer_DestinationErrors checks that the leader keeps retrying through destination errors
+func TestSyncer_DestinationErrors(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay:     time.Second,
+		RetryBackoff:    time.Millisecond * 100,
+		MaxRetryBackoff: time.Millisecond * 200,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	target := []*Target{{IP: "1"}}
+
+	dst.setErr(fmt.Errorf("destination unavailable"))
+	src.ch <- target
+	time.Sleep(time.Second)
+
+	if failures := syncer.ConsecutiveFailures(); failures == 0 {
+		t.Fatalf("Expected failures to be recorded")
+	}
+
+	// Once the destination recovers the targets should be synced without a source change
+	dst.setErr(nil)
+	time.Sleep(time.Second)
+
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(target, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, target, tgts)
+	}
+	if failures := syncer.ConsecutiveFailures(); failures != 0 {
+		t.Fatalf("Expected failures to be reset, got %d", failures)
+	}
+}
+
+// TestSyncer_MaxFailures checks that the lock is released and re-acquired after `MaxFailures`
+func TestSyncer_MaxFailures(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Millisecond * 100,
+		},
+		RemoveDelay:     time.Second,
+		RetryBackoff:    time.Millisecond * 10,
+		MaxRetryBackoff: time.Millisecond * 10,
+		MaxFailures:     2,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	locker := &mockLocker{}
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: locker,
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	dst.setErr(fmt.Errorf("destination unavailable"))
+	src.ch <- []*Target{{IP: "1"}}
+	time.Sleep(time.Millisecond * 500)
+
+	if locks := atomic.LoadInt64(&locker.locks); locks < 2 {
+		t.Fatalf("Expected lock to be re-acquired, got %d locks", locks)
+	}
+}
+
+// TestSyncer_MaxFailuresStopped checks that a stopped destination doesn't keep
+// the lock held while the others fail
+func TestSyncer_MaxFailuresStopped(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Millisecond * 100,
+		},
+		RemoveDelay:     time.Second,
+		RetryBackoff:    time.Millisecond * 10,
+		MaxRetryBackoff: time.Millisecond * 10,
+		MaxFailures:     2,
+	}
+
+	src := newmockSource()
+	dstA := newmockDestination()
+	dstA.setErr(fmt.Errorf("%w: target group gone", ErrDestinationNotFound))
+	dstB := newmockDestination()
+	dstB.setErr(fmt.Errorf("destination unavailable"))
+	locker := &mockLocker{}
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: locker,
+		Src:    src,
+		Dsts: map[string]TargetDestination{
+			"a": dstA,
+			"b": dstB,
+		},
+	}
+
+	go syncer.Run(context.TODO())
+
+	src.ch <- []*Target{{IP: "1"}}
+	time.Sleep(time.Millisecond * 500)
+
+	if locks := atomic.LoadInt64(&locker.locks); locks < 2 {
+		t.Fatalf("Expected lock to be re-acquired, got %d locks", locks)
+	}
+}
+
+// TestSyncer_RemovalThresholds checks that the safety thresholds block mass removals
+func TestSyncer_RemovalThresholds(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay:       time.Second,
+		MaxRemoveFraction: 0.5,
+		PreventEmpty:      true,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	targets := []*Target{{IP: "1"}, {IP: "2"}, {IP: "3"}, {IP: "4"}}
+
+	steps := []struct {
+		src      []*Target
+		expected []*Target
+		blocked  bool
+	}{
+		{src: targets, expected: targets},
+		// removing 3/4 is over the max fraction
+		{src: targets[:1], expected: targets, blocked: true},
+		{src: targets[:2], expected: targets[:2]},
+		{src: targets[:1], expected: targets[:1]},
+		// removing the last target is never allowed
+		{src: []*Target{}, expected: targets[:1], blocked: true},
+	}
+
+	for i, step := range steps {
+		src.ch <- step.src
+		time.Sleep(time.Second * 2)
+
+		tgts, _ := dst.GetTargets(nil)
+		if err := equalTargets(step.expected, tgts); err != nil {
+			t.Fatalf("%d: Mismatch in targets err=%v expected=%+v actual=%+v", i, err, step.expected, tgts)
+		}
+		if blocked := syncer.Status().RemovalsBlocked != ""; blocked != step.blocked {
+			t.Fatalf("%d: Mismatch in removals blocked expected=%v actual=%v", i, step.blocked, blocked)
+		}
+	}
+}
+
+// TestSyncer_DryRun checks that no changes are made to the destination in dry-run mode
+func TestSyncer_DryRun(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay: time.Second,
+		DryRun:      true,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	existing := []*Target{{IP: "2"}}
+	dst.AddTargets(nil, existing)
+
+	go syncer.Run(context.TODO())
+
+	src.ch <- []*Target{{IP: "1"}}
+	time.Sleep(time.Second * 2)
+
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(existing, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, existing, tgts)
+	}
+
+	actions := make(map[string]string)
+	for _, change := range syncer.DryRunChanges() {
+		actions[change.Target.Key()] = change.Action
+	}
+	expected := map[string]string{"1:0": "add", "2:0": "remove"}
+	if len(actions) != len(expected) {
+		t.Fatalf("Mismatch in changes expected=%v actual=%v", expected, actions)
+	}
+	for k, v := range expected {
+		if actions[k] != v {
+			t.Fatalf("Mismatch in changes expected=%v actual=%v", expected, actions)
+		}
+	}
+
+	// Changes which would no longer be made are dropped
+	src.ch <- []*Target{{IP: "2"}, {IP: "3"}}
+	time.Sleep(time.Second)
+	changes := syncer.DryRunChanges()
+	if len(changes) != 1 || changes[0].Target.Key() != "3:0" || changes[0].Action != "add" {
+		t.Fatalf("Expected only the add of 3:0, got: %+v", changes)
+	}
+}
+
+// TestDryRunDestination_record checks that repeated changes keep the time they
+// were first recorded
+func TestDryRunDestination_record(t *testing.T) {
+	d := newDryRunDestination(newmockDestination(), logrus.WithField("test", true), defaultDestination)
+	target := []*Target{{IP: "1"}}
+
+	d.record("add", target)
+	first := d.Changes()[0].Time
+	time.Sleep(10 * time.Millisecond)
+	d.record("add", target)
+	if changes := d.Changes(); len(changes) != 1 || !changes[0].Time.Equal(first) {
+		t.Fatalf("Expected the repeated add to keep its time %v, got: %+v", first, changes)
+	}
+
+	// A flipped action is a new change
+	d.record("remove", target)
+	if changes := d.Changes(); len(changes) != 1 || changes[0].Action != "remove" || !changes[0].Time.After(first) {
+		t.Fatalf("Expected a new remove after %v, got: %+v", first, changes)
+	}
+}
+
+func TestSyncer_SyncOnce(t *testing.T) {
+	cfg := &SyncConfig{
+		PreventEmpty: true,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Src:    src,
+		Dst:    dst,
+	}
+
+	dst.AddTargets(nil, []*Target{{IP: "2"}})
+	target := []*Target{{IP: "1"}}
+	go func() { src.ch <- target }()
+
+	diffs, err := syncer.SyncOnce(context.TODO())
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	if len(diffs) != 1 || len(diffs[0].Add) != 1 || len(diffs[0].Remove) != 1 {
+		t.Fatalf("Unexpected diffs: %+v", diffs)
+	}
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(target, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, target, tgts)
+	}
+
+	// Removing the last target should be blocked
+	go func() { src.ch <- []*Target{} }()
+	if _, err := syncer.SyncOnce(context.TODO()); !errors.Is(err, ErrRemovalsBlocked) {
+		t.Fatalf("Expected removals to be blocked, got: %v", err)
+	}
+	tgts, _ = dst.GetTargets(nil)
+	if err := equalTargets(target, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, target, tgts)
+	}
+}
+
+// TestSyncer_FanOut checks that multiple destinations are reconciled independently
+func TestSyncer_FanOut(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay:     time.Second,
+		RetryBackoff:    time.Millisecond * 100,
+		MaxRetryBackoff: time.Millisecond * 200,
+		MaxFailures:     2,
+	}
+
+	src := newmockSource()
+	dstA := &mockMappedDestination{mockDestination: newmockDestination(), port: 8080}
+	dstB := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dsts: map[string]TargetDestination{
+			"a": dstA,
+			"b": dstB,
+		},
+	}
+
+	go syncer.Run(context.TODO())
+
+	targets := []*Target{{IP: "1", Port: 80}, {IP: "1", Port: 81}, {IP: "2", Port: 80}}
+	mapped := []*Target{{IP: "1", Port: 8080}, {IP: "2", Port: 8080}}
+
+	// A failing destination shouldn't hold up the others (or release the lock)
+	dstB.setErr(fmt.Errorf("destination unavailable"))
+	src.ch <- targets
+	time.Sleep(time.Second)
+
+	tgts, _ := dstA.GetTargets(nil)
+	if err := equalTargets(mapped, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, mapped, tgts)
+	}
+	status := syncer.Status()
+	if len(status.Destinations) != 2 {
+		t.Fatalf("Expected 2 destinations, got: %+v", status.Destinations)
+	}
+	if a, b := status.Destinations[0], status.Destinations[1]; a.ConsecutiveFailures != 0 || b.ConsecutiveFailures < cfg.MaxFailures {
+		t.Fatalf("Unexpected destination failures: %+v", status.Destinations)
+	}
+	if !status.Leader {
+		t.Fatalf("Expected to still be the leader")
+	}
+
+	dstB.setErr(nil)
+	time.Sleep(time.Second)
+
+	tgts, _ = dstB.GetTargets(nil)
+	if err := equalTargets(targets, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, targets, tgts)
+	}
+}
+
+// TestSyncer_BatchedRemovals checks that removals due at the same time are done in a single call
+func TestSyncer_BatchedRemovals(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay: time.Second,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	targets := []*Target{{IP: "1"}, {IP: "2"}, {IP: "3"}}
+	empty := []*Target{}
+
+	src.ch <- targets
+	time.Sleep(time.Second)
+	src.ch <- empty
+	time.Sleep(time.Second * 3)
+
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(empty, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, empty, tgts)
+	}
+	dst.l.RLock()
+	defer dst.l.RUnlock()
+	if dst.removeCalls != 1 {
+		t.Fatalf("Expected a single removal call, got %d", dst.removeCalls)
+	}
+}
+
+// TestSyncer_TypedDestinationErrors checks how the syncer acts on the typed destination errors
+func TestSyncer_TypedDestinationErrors(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay:     time.Second,
+		RetryBackoff:    time.Millisecond * 100,
+		MaxRetryBackoff: time.Millisecond * 200,
+	}
+
+	src := newmockSource()
+	dstA := newmockDestination()
+	dstA.invalid = map[string]bool{"2:0": true}
+	dstB := newmockDestination()
+	dstB.setErr(fmt.Errorf("%w: target group gone", ErrDestinationNotFound))
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dsts: map[string]TargetDestination{
+			"a": dstA,
+			"b": dstB,
+		},
+	}
+
+	go syncer.Run(context.TODO())
+
+	// The invalid target is skipped, and the rest added
+	src.ch <- []*Target{{IP: "1"}, {IP: "2"}, {IP: "3"}}
+	time.Sleep(time.Second)
+
+	expected := []*Target{{IP: "1"}, {IP: "3"}}
+	tgts, _ := dstA.GetTargets(nil)
+	if err := equalTargets(expected, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, tgts)
+	}
+
+	// The missing destination is no longer synced, without affecting the others
+	status := syncer.Status()
+	if !status.Leader {
+		t.Fatalf("Expected to still be the leader")
+	}
+	if status.Destinations[0].Stopped != "" || status.Destinations[1].Stopped == "" {
+		t.Fatalf("Expected only destination b to be stopped: %+v", status.Destinations)
+	}
+}
+
+// TestSyncer_WaitForHealthy checks that removals are deferred until new targets are healthy
+func TestSyncer_WaitForHealthy(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	healthCheckInterval = time.Millisecond * 100
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay:    time.Second,
+		WaitForHealthy: true,
+		HealthyTimeout: time.Second * 3,
+	}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	oldTargets := []*Target{{IP: "1"}}
+	newTargets := []*Target{{IP: "2"}}
+	dst.setHealthy("2:0", false)
+
+	src.ch <- oldTargets
+	time.Sleep(time.Second)
+
+	// The old target is kept while the new one is unhealthy
+	src.ch <- newTargets
+	time.Sleep(time.Second * 2)
+	both := append(oldTargets, newTargets...)
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(both, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, both, tgts)
+	}
+
+	// Once it is healthy the removal goes ahead
+	dst.setHealthy("2:0", true)
+	time.Sleep(time.Millisecond * 500)
+	tgts, _ = dst.GetTargets(nil)
+	if err := equalTargets(newTargets, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, newTargets, tgts)
+	}
+
+	// A target which never becomes healthy only defers removals until the timeout
+	dst.setHealthy("3:0", false)
+	src.ch <- []*Target{{IP: "3"}}
+	time.Sleep(time.Second * 2)
+	if tgts, _ = dst.GetTargets(nil); len(tgts) != 2 {
+		t.Fatalf("Expected removal to be deferred, got: %+v", tgts)
+	}
+	time.Sleep(time.Second * 2)
+	expected := []*Target{{IP: "3"}}
+	tgts, _ = dst.GetTargets(nil)
+	if err := equalTargets(expected, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, tgts)
+	}
+}
+
+// slowHealthDestination blocks fetching the target health until released
+type slowHealthDestination struct {
+	*mockDestination
+	release chan struct{}
+}
+
+func (d *slowHealthDestination) GetTargetHealth(ctx context.Context) ([]*TargetHealth, error) {
+	<-d.release
+	return d.mockDestination.GetTargetHealth(ctx)
+}
+
+// TestSyncer_WaitForHealthySlow checks that a slow health check doesn't hold
+// up changes to the removal queue
+func TestSyncer_WaitForHealthySlow(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	healthCheckInterval = time.Millisecond * 100
+	cfg := &SyncConfig{
+		LockOptions: LockOptions{
+			Key: "a",
+			TTL: time.Second,
+		},
+		RemoveDelay:    time.Second,
+		WaitForHealthy: true,
+		HealthyTimeout: time.Second * 10,
+	}
+
+	src := newmockSource()
+	dst := &slowHealthDestination{mockDestination: newmockDestination(), release: make(chan struct{})}
+	syncer := &Syncer{
+		Config: cfg,
+		Locker: &mockLocker{},
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go syncer.Run(context.TODO())
+
+	src.ch <- []*Target{{IP: "1"}}
+	time.Sleep(time.Second)
+	// 1 is due for removal while the health of 2 is being fetched
+	src.ch <- []*Target{{IP: "2"}}
+	time.Sleep(time.Millisecond * 1500)
+
+	// Re-adding 1 takes it out of the removal queue
+	expected := []*Target{{IP: "1"}, {IP: "2"}, {IP: "3"}}
+	src.ch <- expected
+	time.Sleep(time.Millisecond * 500)
+	tgts, _ := dst.GetTargets(nil)
+	if err := equalTargets(expected, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, tgts)
+	}
+
+	close(dst.release)
+	time.Sleep(time.Millisecond * 500)
+	tgts, _ = dst.GetTargets(nil)
+	if err := equalTargets(expected, tgts); err != nil {
+		t.Fatalf("Mismatch in targets err=%v expected=%+v actual=%+v", err, expected, tgts)
+	}
+}
+
+func TestSyncer_TargetHealth(t *testing.T) {
+	cfg := &SyncConfig{}
+
+	src := newmockSource()
+	dst := newmockDestination()
+	dst.setHealthy("2:0", false)
+	syncer := &Syncer{
+		Config: cfg,
+		Src:    src,
+		Dst:    dst,
+	}
+
+	go func() { src.ch <- []*Target{{IP: "2"}, {IP: "1"}} }()
+	if _, err := syncer.SyncOnce(context.TODO()); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+
+	health := syncer.TargetHealth(context.TODO())
+	if len(health) != 1 || health[0].Destination != defaultDestination || len(health[0].Targets) != 2 {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+	if h := health[0].Targets; h[0].Target.IP != "1" || !h[0].Healthy || h[1].Healthy {
+		t.Fatalf("Unexpected target health: %+v %+v", h[0], h[1])
+	}
+}
+
+// TestSyncer_TargetHealthMetrics checks that stale target health isn't exported
+func TestSyncer_TargetHealthMetrics(t *testing.T) {
+	dst := newmockDestination()
+	syncer := &Syncer{
+		Name:   "health-metrics",
+		Config: &SyncConfig{},
+		Dst:    dst,
+	}
+	syncer.init()
+	d := syncer.destinations()[0]
+	exported := func() []*TargetHealth {
+		if v, ok := targetHealth.health.Load(destinationKey{syncer.Name, d.name}); ok {
+			return v.([]*TargetHealth)
+		}
+		return nil
+	}
+
+	syncer.setLeader(true)
+	targets := []*Target{{IP: "1"}, {IP: "2"}}
+	if err := d.dst.AddTargets(context.TODO(), targets); err != nil {
+		t.Fatalf("Error adding targets: %v", err)
+	}
+	if _, err := d.targetHealth(context.TODO()); err != nil {
+		t.Fatalf("Error fetching target health: %v", err)
+	}
+	if h := exported(); len(h) != 2 {
+		t.Fatalf("Expected health of 2 targets, got: %+v", h)
+	}
+
+	// Removed targets are dropped straight away
+	if err := d.dst.RemoveTargets(context.TODO(), targets[:1]); err != nil {
+		t.Fatalf("Error removing targets: %v", err)
+	}
+	if h := exported(); len(h) != 1 || h[0].Target.IP != "2" {
+		t.Fatalf("Expected health of target 2 only, got: %+v", h)
+	}
+
+	// As is everything once we are no longer the leader
+	syncer.setLeader(false)
+	if h := exported(); h != nil {
+		t.Fatalf("Expected no health once no longer the leader, got: %+v", h)
+	}
+}
@@ -0,0 +1,156 @@
+package targetsync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/sirupsen/logrus"
+)
+
+// verify checks that the target group exists, that its config is usable with
+// the target group and that we are able to read its targets
+func (tg *AWSTargetGroup) verify(ctx context.Context) error {
+	input := &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{aws.String(tg.cfg.TargetGroupARN)},
+	}
+	var result *elbv2.DescribeTargetGroupsOutput
+	err := retryThrottled(ctx, func() (err error) {
+		result, err = tg.svc.DescribeTargetGroupsWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error describing target group: %v", err)
+	}
+	if len(result.TargetGroups) != 1 {
+		return fmt.Errorf("target group not found")
+	}
+	group := result.TargetGroups[0]
+	tg.targetType = aws.StringValue(group.TargetType)
+	logrus.Infof("Target group %s: type=%s protocol=%s port=%d vpc=%s", tg.cfg.TargetGroupARN,
+		tg.targetType, aws.StringValue(group.Protocol), aws.Int64Value(group.Port), aws.StringValue(group.VpcId))
+
+	switch tg.targetType {
+	case elbv2.TargetTypeEnumIp, elbv2.TargetTypeEnumInstance:
+		if aws.StringValue(group.Protocol) == "" || aws.Int64Value(group.Port) == 0 {
+			return fmt.Errorf("target group has no protocol or port")
+		}
+		if (tg.cfg.AvailabilityZone != "" || len(tg.cfg.AvailabilityZoneCIDRs) > 0) && tg.targetType != elbv2.TargetTypeEnumIp {
+			return fmt.Errorf("availability_zone and availability_zone_cidrs are only supported for ip target groups")
+		}
+	case elbv2.TargetTypeEnumLambda:
+		// Lambda targets are function ARNs, which none of the sources provide
+		return fmt.Errorf("lambda target groups aren't supported, targets must be IPs or instances")
+	default:
+		return fmt.Errorf("unsupported target type %q", tg.targetType)
+	}
+	if tg.cfg.VPCID != "" && aws.StringValue(group.VpcId) != tg.cfg.VPCID {
+		return fmt.Errorf("target group is in vpc %s, expected %s", aws.StringValue(group.VpcId), tg.cfg.VPCID)
+	}
+
+	// Make sure we can actually read the targets
+	healthInput := &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tg.cfg.TargetGroupARN),
+	}
+	err = retryThrottled(ctx, func() error {
+		_, err := tg.svc.DescribeTargetHealthWithContext(ctx, healthInput)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error describing target health: %v", err)
+	}
+	return nil
+}
+
+// requiredActions returns the IAM actions required to sync the target group
+// (or only read it if `readOnly`)
+func (tg *AWSTargetGroup) requiredActions(readOnly bool) []string {
+	actions := []string{"elasticloadbalancing:DescribeTargetHealth"}
+	if !readOnly {
+		actions = append(actions, "elasticloadbalancing:RegisterTargets", "elasticloadbalancing:DeregisterTargets")
+	}
+	if tg.targetType == elbv2.TargetTypeEnumInstance {
+		actions = append(actions, "ec2:DescribeInstances")
+	}
+	return actions
+}
+
+// permissionChecker verifies that the caller of a session is allowed to take
+// actions by simulating its IAM policies. As simulating requires permissions
+// itself this is best-effort, it only fails if an action is known to be denied
+type permissionChecker struct {
+	sts stsiface.STSAPI
+	iam iamiface.IAMAPI
+
+	// principal is the ARN of the caller (once looked up)
+	principal string
+}
+
+// check returns an error if any of `actions` on `resource` are explicitly
+// denied. Implicit denies are only logged as the simulation doesn't have the
+// request context (e.g. tags or the source VPC) that conditions may allow on
+func (p *permissionChecker) check(ctx context.Context, actions []string, resource string) error {
+	if p.principal == "" {
+		identity, err := p.sts.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			// e.g. STS isn't reachable from a VPC with only an elbv2 endpoint
+			logrus.Warnf("Unable to verify permissions, error getting caller identity: %v", err)
+			return nil
+		}
+		p.principal = principalARN(aws.StringValue(identity.Arn))
+	}
+
+	input := &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(p.principal),
+		ActionNames:     aws.StringSlice(actions),
+		ResourceArns:    aws.StringSlice([]string{resource}),
+	}
+	denied := make([]string, 0)
+	notAllowed := make([]string, 0)
+	err := p.iam.SimulatePrincipalPolicyPagesWithContext(ctx, input, func(page *iam.SimulatePolicyResponse, _ bool) bool {
+		for _, result := range page.EvaluationResults {
+			switch aws.StringValue(result.EvalDecision) {
+			case iam.PolicyEvaluationDecisionTypeAllowed:
+			case iam.PolicyEvaluationDecisionTypeExplicitDeny:
+				denied = append(denied, aws.StringValue(result.EvalActionName))
+			default:
+				notAllowed = append(notAllowed, aws.StringValue(result.EvalActionName))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "AccessDenied" || aerr.Code() == iam.ErrCodeNoSuchEntityException || aerr.Code() == iam.ErrCodeInvalidInputException) {
+			logrus.Warnf("Unable to verify the permissions of %s: %v", p.principal, err)
+			return nil
+		}
+		return fmt.Errorf("Error simulating policy: %v", err)
+	}
+	if len(notAllowed) > 0 {
+		logrus.Warnf("%s may not be allowed to %s on %s, no policy allows it without conditions", p.principal, strings.Join(notAllowed, ", "), resource)
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("%s is not allowed to %s on %s", p.principal, strings.Join(denied, ", "), resource)
+	}
+	return nil
+}
+
+// principalARN returns the ARN to simulate the policies of for the caller `arn`.
+// Assumed roles are mapped back to their role (which only works for roles
+// without a path, as the path isn't part of the assumed role ARN)
+func principalARN(arn string) string {
+	// arn:partition:sts::account:assumed-role/role-name/session-name
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[2] != "sts" || !strings.HasPrefix(parts[5], "assumed-role/") {
+		return arn
+	}
+	role := strings.SplitN(strings.TrimPrefix(parts[5], "assumed-role/"), "/", 2)[0]
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", parts[1], parts[4], role)
+}
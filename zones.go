@@ -0,0 +1,136 @@
+package targetsync
+
+import (
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/sirupsen/logrus"
+)
+
+// The same IP+Port can be registered in a target group once per availability
+// zone, so for "ip" target groups AWSTargetGroup tracks the zone each target
+// should be in (from MapTargets) and the zones it is registered in (from
+// GetTargetHealth). Targets registered in the wrong zone are hidden from
+// GetTargets so that the Syncer adds them again, at which point AddTargets
+// registers them in the right zone and deregisters the stale registrations
+
+// targetZone returns the zone to register `target` in ("" to let AWS decide).
+// The configured zone wins, then the zone of a matching CIDR, then the zone
+// from the source
+func (tg *AWSTargetGroup) targetZone(target *Target) string {
+	if tg.cfg.AvailabilityZone != "" {
+		return tg.cfg.AvailabilityZone
+	}
+	if zone, ok := tg.cfg.cidrZone(target.IP); ok {
+		return zone
+	}
+	return target.AvailabilityZone
+}
+
+// zoneTargets returns `targets` with the zone they should be registered in,
+// recording it so that GetTargets can find targets in the wrong zone
+func (tg *AWSTargetGroup) zoneTargets(targets []*Target) []*Target {
+	if tg.targetType != elbv2.TargetTypeEnumIp {
+		return targets
+	}
+	tg.l.Lock()
+	defer tg.l.Unlock()
+	if tg.zones == nil {
+		tg.zones = make(map[string]string)
+	}
+	zoned := make([]*Target, len(targets))
+	for i, target := range targets {
+		zoned[i] = target
+		if zone := tg.targetZone(target); zone != target.AvailabilityZone {
+			zoned[i] = target.withZone(zone)
+		}
+		tg.zones[target.Key()] = zoned[i].AvailabilityZone
+	}
+	return zoned
+}
+
+// setRegistered records the zones of the (non-draining) registrations in `health`
+func (tg *AWSTargetGroup) setRegistered(health []*TargetHealth) {
+	if tg.targetType != elbv2.TargetTypeEnumIp {
+		return
+	}
+	tg.l.Lock()
+	defer tg.l.Unlock()
+	tg.registered = make(map[string][]string)
+	for _, h := range health {
+		if h.State != elbv2.TargetHealthStateEnumDraining {
+			key := h.Target.Key()
+			tg.registered[key] = append(tg.registered[key], h.Target.AvailabilityZone)
+		}
+	}
+	// Targets which were removed no longer need their zone
+	for key := range tg.zones {
+		if _, ok := tg.registered[key]; !ok {
+			delete(tg.zones, key)
+		}
+	}
+}
+
+// wrongZone returns the keys of the targets with a registration outside the
+// zone they should be in
+func (tg *AWSTargetGroup) wrongZone() map[string]struct{} {
+	tg.l.Lock()
+	defer tg.l.Unlock()
+	keys := make(map[string]struct{})
+	for key, zones := range tg.registered {
+		want, ok := tg.zones[key]
+		if !ok || want == "" {
+			continue
+		}
+		for _, zone := range zones {
+			if zone != want {
+				logrus.Infof("Target %s is registered in zone %q instead of %q, re-registering it", key, zone, want)
+				keys[key] = struct{}{}
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// staleRegistrations returns the registrations of `targets` outside of the zone
+// each target is being registered in
+func (tg *AWSTargetGroup) staleRegistrations(targets []*Target) []*Target {
+	if tg.targetType != elbv2.TargetTypeEnumIp {
+		return nil
+	}
+	tg.l.Lock()
+	defer tg.l.Unlock()
+	stale := make([]*Target, 0)
+	for _, target := range targets {
+		// Without a zone AWS picks it, so there is nothing to compare against
+		if target.AvailabilityZone == "" {
+			continue
+		}
+		for _, zone := range tg.registered[target.Key()] {
+			if zone != target.AvailabilityZone {
+				stale = append(stale, target.withZone(zone))
+			}
+		}
+	}
+	return stale
+}
+
+// allRegistrations returns every registration of `targets` (in any zone)
+func (tg *AWSTargetGroup) allRegistrations(targets []*Target) []*Target {
+	if tg.targetType != elbv2.TargetTypeEnumIp {
+		return targets
+	}
+	tg.l.Lock()
+	defer tg.l.Unlock()
+	all := make([]*Target, 0, len(targets))
+	for _, target := range targets {
+		zones, ok := tg.registered[target.Key()]
+		if !ok {
+			all = append(all, target)
+			continue
+		}
+		for _, zone := range zones {
+			all = append(all, target.withZone(zone))
+		}
+	}
+	return all
+}